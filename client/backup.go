@@ -0,0 +1,294 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kpango/glg"
+)
+
+// BackupOptions control how a local tree is uploaded.
+type BackupOptions struct {
+	// Called after each uploaded or deleted entry.
+	Progress func(path string, action string)
+}
+
+type backuper struct {
+	b      *BoxBackup
+	opts   *BackupOptions
+	failed int
+	// Block size of the store, 0 until asked and -1 if unknown.
+	blockSize int64
+	// Error which stopped the backup, such as a full or locked store.
+	aborted error
+}
+
+// Mirrors the local directory into remote directory id, like bbackupd does.
+//
+// Missing directories are created and new or changed files are uploaded,
+// along with symlinks, FIFOs and device nodes. Sockets are skipped. Errors of
+// single entries are counted and the backup goes on, while errors such as
+// ErrStorageLimitExceeded or ErrCannotLockStoreForWriting stop it.
+// Files are compared by modification time, mode and ownership, and regular
+// files by size: when the size in the listing, in store blocks, does not match
+// the local one, the data size in the block index decides. Attributes of
+// existing directories are updated when they differ. Remote entries which no
+// longer exist locally are marked as deleted, keeping them restorable until
+// housekeeping removes them.
+func (b *BoxBackup) Backup(local string, id int64, opts *BackupOptions) error {
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+	fi, err := os.Stat(local)
+	if err != nil {
+		return fmt.Errorf("backup: %v", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("backup: %s is not a directory", local)
+	}
+	u := &backuper{
+		b:    b,
+		opts: opts,
+	}
+	u.backupDir(local, id)
+	if u.aborted != nil {
+		return fmt.Errorf("backup: %w", u.aborted)
+	}
+	if u.failed > 0 {
+		return fmt.Errorf("backup: %v entries failed", u.failed)
+	}
+	return nil
+}
+
+func (u *backuper) progress(p, action string) {
+	if u.opts.Progress != nil {
+		u.opts.Progress(p, action)
+	}
+}
+
+func (u *backuper) fail(p string, err error) {
+	glg.Errorf("Unable to back up %s: %s", p, err)
+	u.failed++
+	if u.aborted == nil && sessionError(err) {
+		u.aborted = err
+	}
+}
+
+// Checks whether the stored entry still describes the local file. Owner, mode
+// and extended attributes are checked with the attribute hash, when the store
+// has one.
+func (u *backuper) unchanged(e *RemoteFile, p string, fi os.FileInfo) bool {
+	if e.ModificationTime.Unix() != fi.ModTime().Unix() {
+		return false
+	}
+	if fi.Mode().IsRegular() && !u.sameSize(e, fi) {
+		return false
+	}
+	if e.AttributesHash != 0 {
+		h, err := u.b.LocalAttributesHash(p)
+		return err == nil && h == e.AttributesHash
+	}
+	uid, gid := fileOwner(fi)
+	return e.mode.Perm() == fi.Mode().Perm() && e.UID == uid && e.GID == gid
+}
+
+// Compares the size of the local file with the data of the stored one. The
+// listing only has the size in store blocks, which is conclusive when it
+// matches the local size rounded up. Compressed files and diffs take fewer
+// blocks, so otherwise the block index is fetched.
+func (u *backuper) sameSize(e *RemoteFile, fi os.FileInfo) bool {
+	if bs := u.storeBlockSize(); bs > 0 && e.size == (fi.Size()+bs-1)/bs {
+		return true
+	}
+	idx, err := u.b.blockIndexByID(context.Background(), e.Id)
+	if err != nil {
+		glg.Warnf("Unable to get block index of %s: %s", e.Name(), err)
+		return false
+	}
+	return idx.dataSize() == fi.Size()
+}
+
+// Returns the block size of the store, asking for it once.
+func (u *backuper) storeBlockSize() int64 {
+	if u.blockSize == 0 {
+		u.blockSize = -1
+		if au, err := u.b.GetAccountUsage(); err != nil {
+			glg.Warnf("Unable to get the block size: %s", err)
+		} else if au.BlockSize > 0 {
+			u.blockSize = au.BlockSize
+		}
+	}
+	return u.blockSize
+}
+
+// Updates the attributes of the listed remote directory d when the mode,
+// owner or extended attributes of the local one differ.
+func (u *backuper) updateDir(local string, d *RemoteFile) error {
+	fi, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	a := &RemoteFile{}
+	a.SetAttributes(fi)
+	if a.Xattrs, err = readXattrs(local); err != nil {
+		return err
+	}
+	if d.mode.Perm() == a.mode.Perm() && d.UID == a.UID && d.GID == a.GID &&
+		sameXattrs(d.Xattrs, a.Xattrs) {
+		return nil
+	}
+	if err := u.b.ChangeDirAttributes(d.Id, a); err != nil {
+		return err
+	}
+	u.progress(local, "attributes")
+	return nil
+}
+
+func sameXattrs(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n, v := range a {
+		if w, ok := b[n]; !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *backuper) backupDir(local string, id int64) {
+	d, err := u.b.listDirectory(context.Background(), id)
+	if err != nil {
+		u.fail(local, err)
+		return
+	}
+	if err := u.updateDir(local, d); err != nil {
+		u.fail(local, err)
+		if u.aborted != nil {
+			return
+		}
+	}
+	de := d.entries
+	remote := make(map[string]*RemoteFile)
+	for _, e := range de {
+		if e.Flags&(proto.Flags_Deleted|proto.Flags_OldVersion) == 0 {
+			remote[e.Name()] = e
+		}
+	}
+
+	files, err := ioutil.ReadDir(local)
+	if err != nil {
+		u.fail(local, err)
+		return
+	}
+	seen := make(map[string]bool)
+	for _, fi := range files {
+		if u.aborted != nil {
+			return
+		}
+		p := filepath.Join(local, fi.Name())
+		e := remote[fi.Name()]
+		seen[fi.Name()] = true
+
+		// Entry changed its type, remove the old one first.
+		if e != nil && e.IsDir() != fi.IsDir() {
+			if err := u.delete(id, e); err != nil {
+				u.fail(p, err)
+				continue
+			}
+			e = nil
+		}
+
+		switch {
+		case fi.IsDir():
+			d := int64(0)
+			if e != nil {
+				d = e.Id
+			} else {
+				a := &RemoteFile{}
+				a.SetAttributes(fi)
+				if a.Xattrs, err = readXattrs(p); err != nil {
+					u.fail(p, err)
+					continue
+				}
+				if d, err = u.b.CreateDirectory(id, fi.Name(), a); err != nil {
+					u.fail(p, err)
+					continue
+				}
+				u.progress(p, "mkdir")
+			}
+			u.backupDir(p, d)
+
+		case fi.Mode().IsRegular(), fi.Mode()&(os.ModeSymlink|os.ModeNamedPipe|os.ModeDevice) != 0:
+			if e != nil && e.Mode().Type() == fi.Mode().Type() && u.unchanged(e, p, fi) {
+				continue
+			}
+			if err := u.upload(id, p, fi); err != nil {
+				u.fail(p, err)
+				continue
+			}
+			u.progress(p, "upload")
+
+		default:
+			glg.Warnf("Skipping special file %s (%v)", p, fi.Mode())
+		}
+	}
+
+	for _, e := range de {
+		if u.aborted != nil {
+			return
+		}
+		if seen[e.Name()] || remote[e.Name()] != e {
+			continue
+		}
+		p := filepath.Join(local, e.Name())
+		if err := u.delete(id, e); err != nil {
+			u.fail(p, err)
+			continue
+		}
+		u.progress(p, "delete")
+	}
+}
+
+// Uploads a regular file, or a symlink, FIFO or device node as an entry
+// without data.
+func (u *backuper) upload(dir int64, p string, fi os.FileInfo) error {
+	rf, err := u.b.CreateFile(dir, fi.Name())
+	if err != nil {
+		return err
+	}
+	rf.SetAttributes(fi)
+	if rf.Xattrs, err = readXattrs(p); err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		if rf.Symlink, err = os.Readlink(p); err != nil {
+			return err
+		}
+	case fi.Mode().IsRegular():
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(rf, f); err != nil {
+			return err
+		}
+	}
+	return rf.Commit()
+}
+
+func (u *backuper) delete(dir int64, e *RemoteFile) error {
+	if e.IsDir() {
+		return u.b.DeleteDirectory(e.Id)
+	}
+	return u.b.DeleteFile(dir, e.Name())
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupStorageLimit(t *testing.T) {
+	bb, ts := newTestStore(t)
+	ts.full = true
+	dir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("f%v", i)), []byte("data"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := bb.Backup(dir, 1, nil)
+	if !errors.Is(err, ErrStorageLimitExceeded) {
+		t.Errorf("Backup: %v, want %v", err, ErrStorageLimitExceeded)
+	}
+	if ts.uploads != 1 {
+		t.Errorf("Backup went on after a full store: %v uploads", ts.uploads)
+	}
+}
+
+func TestBackupSize(t *testing.T) {
+	bb, ts := newTestStore(t)
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a")
+	e := ts.addFile(1, 10, "a", []byte("data"))
+	// Gives the local file the stored time and attributes, with the data.
+	write := func(data string) {
+		if err := ioutil.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, e.ModificationTime, e.ModificationTime)
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.mode = fi.Mode()
+		e.UID, e.GID = fileOwner(fi)
+	}
+
+	write("data")
+	if err := bb.Backup(dir, 1, nil); err != nil || ts.uploads != 0 {
+		t.Errorf("Unchanged file: %v, %v uploads", err, ts.uploads)
+	}
+	if ts.indexes != 0 {
+		t.Errorf("Unchanged file: %v block index requests, want 0", ts.indexes)
+	}
+
+	// Takes fewer blocks in the store, like a compressed file.
+	long := strings.Repeat("x", 3000)
+	ts.data[10] = []byte(long)
+	write(long)
+	if err := bb.Backup(dir, 1, nil); err != nil || ts.uploads != 0 {
+		t.Errorf("Compressed file: %v, %v uploads", err, ts.uploads)
+	}
+	if ts.indexes != 1 {
+		t.Errorf("Compressed file: %v block index requests, want 1", ts.indexes)
+	}
+
+	write(long + "more data")
+	bb.Backup(dir, 1, nil)
+	if ts.uploads != 1 {
+		t.Errorf("Grown file: %v uploads, want 1", ts.uploads)
+	}
+}
+
+func TestBackupDirAttributes(t *testing.T) {
+	bb, ts := newTestStore(t)
+	ts.addDir(1, 2, "sub")
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	var changed []string
+	opts := &BackupOptions{
+		Progress: func(p string, action string) {
+			if action == "attributes" {
+				changed = append(changed, p)
+			}
+		},
+	}
+	if err := bb.Backup(dir, 1, opts); err != nil {
+		t.Fatalf("Backup: %s", err)
+	}
+	if len(changed) != 2 {
+		t.Errorf("Updated attributes of %q, want both directories", changed)
+	}
+	d, err := bb.listDirectory(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Mode().Perm() != 0o750 {
+		t.Errorf("Stored mode %v, want %v", d.Mode().Perm(), os.FileMode(0o750))
+	}
+
+	changed = nil
+	if err := bb.Backup(dir, 1, opts); err != nil || len(changed) != 0 {
+		t.Errorf("Unchanged directories: %v, updated %q", err, changed)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	bb, ts := newTestStore(t)
+	dir := t.TempDir()
+	write := func(p, data string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, p), []byte(data), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	write("a", "first")
+	write("sub/b", strings.Repeat("b", 5000))
+	write("gone", "deleted later")
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bb.Backup(dir, 1, nil); err != nil {
+		t.Fatalf("Backup: %s", err)
+	}
+	if ts.uploads != 4 {
+		t.Errorf("Uploaded %v files, want 4", ts.uploads)
+	}
+
+	write("a", "second")
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(dir, "a"), later, later)
+	os.Remove(filepath.Join(dir, "gone"))
+	ts.uploads = 0
+	if err := bb.Backup(dir, 1, nil); err != nil {
+		t.Fatalf("Backup after changes: %s", err)
+	}
+	if ts.uploads != 1 {
+		t.Errorf("Uploaded %v files after changes, want 1", ts.uploads)
+	}
+	de, err := bb.ReadDir(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := Versions(de, "a")
+	if len(v) != 2 || v[1].Flags&proto.Flags_OldVersion == 0 {
+		t.Errorf("Versions of a: %v, want the old one kept", len(v))
+	}
+	if g := Versions(de, "gone"); len(g) != 1 || g[0].Flags&proto.Flags_Deleted == 0 {
+		t.Errorf("Removed file is not marked deleted")
+	}
+
+	// The store holds the tree as it is now.
+	out := t.TempDir()
+	if err := bb.Restore(1, out, nil); err != nil {
+		t.Fatalf("Restore: %s", err)
+	}
+	for _, p := range []string{"a", "sub/b"} {
+		want, _ := ioutil.ReadFile(filepath.Join(dir, p))
+		got, err := ioutil.ReadFile(filepath.Join(out, p))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Restored %s: %v bytes, %v", p, len(got), err)
+		}
+		fi, _ := os.Stat(filepath.Join(dir, p))
+		if rfi, err := os.Stat(filepath.Join(out, p)); err != nil || rfi.Mode() != fi.Mode() ||
+			!rfi.ModTime().Equal(fi.ModTime().Truncate(time.Second)) {
+			t.Errorf("Restored %s with other attributes: %v", p, err)
+		}
+	}
+	if l, err := os.Readlink(filepath.Join(out, "link")); err != nil || l != "a" {
+		t.Errorf("Restored link to %q: %v", l, err)
+	}
+	if _, err := os.Lstat(filepath.Join(out, "gone")); !os.IsNotExist(err) {
+		t.Errorf("Restored the deleted file: %v", err)
+	}
+}
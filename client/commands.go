@@ -3,47 +3,102 @@ package client
 import (
 	"bbq/client/proto"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/kpango/glg"
 )
 
 func (b *BoxBackup) CheckVersion(version int32) error {
-	p, err := b.Execute(&Operation{Op: proto.Version{Version: version}})
+	return b.CheckVersionContext(context.Background(), version)
+}
+
+// Context variant of CheckVersion.
+func (b *BoxBackup) CheckVersionContext(ctx context.Context, version int32) error {
+	p, err := b.ExecuteContext(ctx, &Operation{Op: proto.Version{Version: version}})
 	if err != nil {
-		return fmt.Errorf("version check failed: %q", err)
+		return fmt.Errorf("version check failed: %w", err)
 	}
+	b.stateMu.Lock()
+	b.version = version
+	b.stateMu.Unlock()
 	glg.Logf("server version: %v", p.(*proto.Version).Version)
 	return nil
 }
 
 func (b *BoxBackup) Login(user int32, ro bool) error {
+	return b.LoginContext(context.Background(), user, ro)
+}
+
+// Context variant of Login.
+func (b *BoxBackup) LoginContext(ctx context.Context, user int32, ro bool) error {
 	f := int32(0)
 	if ro {
 		f = f | 1
 	}
-	p, err := b.Execute(&Operation{Op: proto.Login{
+	l := proto.Login{
 		Client: user,
 		Flags:  f,
-	}})
+	}
+	p, err := b.ExecuteContext(ctx, &Operation{Op: l})
 	if err != nil {
-		return fmt.Errorf("login failed: %q", err)
+		return fmt.Errorf("login failed: %w", err)
 	}
+	b.stateMu.Lock()
+	b.login = &l
+	b.stateMu.Unlock()
 	glg.Logf("logged in: %+v", p.(*proto.LoginConfirmed))
 	return nil
 }
 
 func (b *BoxBackup) Finish() error {
-	_, err := b.Execute(&Operation{Op: proto.Finished{}})
+	return b.FinishContext(context.Background())
+}
+
+// Context variant of Finish.
+func (b *BoxBackup) FinishContext(ctx context.Context) error {
+	_, err := b.ExecuteContext(ctx, &Operation{Op: proto.Finished{}})
 	glg.Log("logged out")
 	return err
 }
 
+// Checks that the server still answers, returning the round-trip time. It
+// includes waiting for a command which is running.
+func (b *BoxBackup) Ping() (time.Duration, error) {
+	return b.PingContext(context.Background())
+}
+
+// Context variant of Ping.
+func (b *BoxBackup) PingContext(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if _, err := b.ExecuteContext(ctx, &Operation{Op: proto.GetIsAlive{}}); err != nil {
+		return 0, fmt.Errorf("ping failed: %w", err)
+	}
+	return time.Since(start), nil
+}
+
 func (b *BoxBackup) ReadDir(id int64) ([]*RemoteFile, error) {
-	p, err := b.Execute(&Operation{Op: proto.ListDirectory{
+	return b.ReadDirContext(context.Background(), id)
+}
+
+// Context variant of ReadDir.
+func (b *BoxBackup) ReadDirContext(ctx context.Context, id int64) ([]*RemoteFile, error) {
+	d, err := b.listDirectory(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return d.entries, nil
+}
+
+// Returns the directory itself, with its container as ParentId and the
+// listing in entries.
+func (b *BoxBackup) listDirectory(ctx context.Context, id int64) (*RemoteFile, error) {
+	p, err := b.ExecuteContext(ctx, &Operation{Op: proto.ListDirectory{
 		ObjectID:        id,
 		FlagsMustBeSet:  -1,
 		FlagsNotToBeSet: 0,
@@ -51,20 +106,30 @@ func (b *BoxBackup) ReadDir(id int64) ([]*RemoteFile, error) {
 		SendAttributes: true,
 	}})
 	if err != nil {
-		return nil, fmt.Errorf("lsdir failed: %q", err)
+		return nil, fmt.Errorf("lsdir failed: %w", err)
 	}
 	glg.Logf("list directory: %v", p.(*proto.Success).ObjectID)
 
-	return b.readStream()
+	s, err := b.GetStream()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return b.readDirStream(s)
 }
 
 func (b *BoxBackup) GetObjectName(d, id int64) ([]string, error) {
-	p, err := b.Execute(&Operation{Op: proto.GetObjectName{
+	return b.GetObjectNameContext(context.Background(), d, id)
+}
+
+// Context variant of GetObjectName.
+func (b *BoxBackup) GetObjectNameContext(ctx context.Context, d, id int64) ([]string, error) {
+	p, err := b.ExecuteContext(ctx, &Operation{Op: proto.GetObjectName{
 		ObjectID:              id,
 		ContainingDirectoryID: d,
 	}})
 	if err != nil {
-		return nil, fmt.Errorf("get object name failed: %q", err)
+		return nil, fmt.Errorf("get object name failed: %w", err)
 	}
 	o := p.(*proto.ObjectName)
 	if o.NumNameElements == 0 {
@@ -77,6 +142,7 @@ func (b *BoxBackup) GetObjectName(d, id int64) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer s.Close()
 	var path []string
 	for i := 0; i < int(o.NumNameElements); i++ {
 		fn, err := b.readFilenameStream(s)
@@ -88,17 +154,13 @@ func (b *BoxBackup) GetObjectName(d, id int64) ([]string, error) {
 	return path, nil
 }
 
-func (b *BoxBackup) GetAccountUsage() error {
-	p, err := b.Execute(&Operation{Op: proto.GetAccountUsage2{}})
-	if err != nil {
-		return fmt.Errorf("get account usage failed: %q", err)
-	}
-	glg.Logf("account usage: %+v", p.(*proto.AccountUsage2))
-	return nil
+func (b *BoxBackup) GetFile(d, id int64) (*RemoteFile, error) {
+	return b.GetFileContext(context.Background(), d, id)
 }
 
-func (b *BoxBackup) GetFile(d, id int64) (*RemoteFile, error) {
-	rf, err := b.OpenFile(d, id)
+// Context variant of GetFile.
+func (b *BoxBackup) GetFileContext(ctx context.Context, d, id int64) (*RemoteFile, error) {
+	rf, err := b.OpenFileContext(ctx, d, id)
 	if err != nil {
 		return nil, err
 	}
@@ -111,11 +173,16 @@ func (b *BoxBackup) GetFile(d, id int64) (*RemoteFile, error) {
 }
 
 func (b *BoxBackup) GetObject(id int64) (*RemoteFile, error) {
-	_, err := b.Execute(&Operation{Op: proto.GetObject{
+	return b.GetObjectContext(context.Background(), id)
+}
+
+// Context variant of GetObject.
+func (b *BoxBackup) GetObjectContext(ctx context.Context, id int64) (*RemoteFile, error) {
+	_, err := b.ExecuteContext(ctx, &Operation{Op: proto.GetObject{
 		ObjectID: id,
 	}})
 	if err != nil {
-		return nil, fmt.Errorf("get object failed: %q", err)
+		return nil, fmt.Errorf("get object failed: %w", err)
 	}
 	f, err := b.readStream()
 	if err != nil {
@@ -128,50 +195,84 @@ func (b *BoxBackup) GetObject(id int64) (*RemoteFile, error) {
 }
 
 func (b *BoxBackup) GetBlockIndexByID(id int64) error {
-	_, err := b.Execute(&Operation{Op: proto.GetBlockIndexByID{
+	return b.GetBlockIndexByIDContext(context.Background(), id)
+}
+
+// Context variant of GetBlockIndexByID.
+func (b *BoxBackup) GetBlockIndexByIDContext(ctx context.Context, id int64) error {
+	_, err := b.blockIndexByID(ctx, id)
+	return err
+}
+
+func (b *BoxBackup) blockIndexByID(ctx context.Context, id int64) (*blockIndex, error) {
+	_, err := b.ExecuteContext(ctx, &Operation{Op: proto.GetBlockIndexByID{
 		ObjectID: id,
 	}})
 	if err != nil {
-		return fmt.Errorf("get index by id failed: %q", err)
+		return nil, fmt.Errorf("get index by id failed: %w", err)
 	}
 	s, err := b.GetStream()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer s.Close()
 	glg.Logf("stream with blocks: %+v", s)
-	b.readBlockIndex(s)
-	return nil
+	return b.readBlockIndex(s), nil
 }
 
 func (b *BoxBackup) GetBlockIndexByName(d int64, fn string) error {
-	ef, err := b.writeFilename(fn)
+	return b.GetBlockIndexByNameContext(context.Background(), d, fn)
+}
+
+// Context variant of GetBlockIndexByName.
+func (b *BoxBackup) GetBlockIndexByNameContext(ctx context.Context, d int64, fn string) error {
+	id, _, err := b.blockIndexByName(ctx, d, fn)
 	if err != nil {
 		return err
 	}
+	if id == 0 {
+		return fmt.Errorf("file %s not found", fn)
+	}
+	return nil
+}
+
+// Fetches the block index of the current file named fn in directory d.
+// Returns zero ID if there is no such file.
+func (b *BoxBackup) blockIndexByName(ctx context.Context, d int64, fn string) (int64, *blockIndex, error) {
+	ef, err := b.writeFilename(fn)
+	if err != nil {
+		return 0, nil, err
+	}
 	op := &Operation{
 		Op: proto.GetBlockIndexByName{
 			InDirectory: d,
 		},
 		Tail: ef,
 	}
-	p, err := b.Execute(op)
+	p, err := b.ExecuteContext(ctx, op)
 	if err != nil {
-		return fmt.Errorf("get index by name failed: %q", err)
+		return 0, nil, fmt.Errorf("get index by name failed: %w", err)
 	}
 
-	if p.(*proto.Success).ObjectID == 0 {
-		return fmt.Errorf("file %s not found", fn)
+	id := p.(*proto.Success).ObjectID
+	if id == 0 {
+		return 0, nil, nil
 	}
 	s, err := b.GetStream()
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
+	defer s.Close()
 	glg.Logf("stream with blocks: %+v", s)
-	b.readBlockIndex(s)
-	return nil
+	return id, b.readBlockIndex(s), nil
 }
 
 func (b *BoxBackup) DeleteFile(d int64, fn string) error {
+	return b.DeleteFileContext(context.Background(), d, fn)
+}
+
+// Context variant of DeleteFile.
+func (b *BoxBackup) DeleteFileContext(ctx context.Context, d int64, fn string) error {
 	ef, err := b.writeFilename(fn)
 	glg.Logf("Delete %s [% X] / [% X]", fn, fn, ef)
 	if err != nil {
@@ -183,22 +284,212 @@ func (b *BoxBackup) DeleteFile(d int64, fn string) error {
 		},
 		Tail: ef,
 	}
-	p, err := b.Execute(op)
+	p, err := b.ExecuteContext(ctx, op)
 	if err != nil {
-		return fmt.Errorf("delete file failed: %q", err)
+		return fmt.Errorf("delete file failed: %w", err)
 	}
+	b.cache.forget(d)
 	if p.(*proto.Success).ObjectID == 0 {
 		return fmt.Errorf("file %s was not found", fn)
 	}
 	return nil
 }
 
+// Removes the deleted mark from file id in directory d. Deleted files are kept
+// on the store until housekeeping removes them.
+func (b *BoxBackup) UndeleteFile(d, id int64) error {
+	return b.UndeleteFileContext(context.Background(), d, id)
+}
+
+// Context variant of UndeleteFile.
+func (b *BoxBackup) UndeleteFileContext(ctx context.Context, d, id int64) error {
+	p, err := b.ExecuteContext(ctx, &Operation{Op: proto.UndeleteFile{
+		InDirectory: d,
+		ObjectID:    id,
+	}})
+	if err != nil {
+		return fmt.Errorf("undelete file failed: %w", err)
+	}
+	b.cache.forget(d)
+	if p.(*proto.Success).ObjectID == 0 {
+		return fmt.Errorf("file %x was not found", id)
+	}
+	return nil
+}
+
+// Marks directory and everything within it as deleted.
+func (b *BoxBackup) DeleteDirectory(id int64) error {
+	return b.DeleteDirectoryContext(context.Background(), id)
+}
+
+// Context variant of DeleteDirectory.
+func (b *BoxBackup) DeleteDirectoryContext(ctx context.Context, id int64) error {
+	if _, err := b.ExecuteContext(ctx, &Operation{Op: proto.DeleteDirectory{
+		ObjectID: id,
+	}}); err != nil {
+		return fmt.Errorf("delete directory failed: %w", err)
+	}
+	b.forgetDir(id)
+	return nil
+}
+
+func (b *BoxBackup) UndeleteDirectory(id int64) error {
+	return b.UndeleteDirectoryContext(context.Background(), id)
+}
+
+// Context variant of UndeleteDirectory.
+func (b *BoxBackup) UndeleteDirectoryContext(ctx context.Context, id int64) error {
+	if _, err := b.ExecuteContext(ctx, &Operation{Op: proto.UndeleteDirectory{
+		ObjectID: id,
+	}}); err != nil {
+		return fmt.Errorf("undelete directory failed: %w", err)
+	}
+	b.forgetDir(id)
+	return nil
+}
+
+// Creates a directory with the given name in parent directory and returns the
+// ID of the new directory. Attributes can be nil, in which case the directory
+// gets owned by the current user with 0755 permissions.
+func (b *BoxBackup) CreateDirectory(parent int64, name string, attrs *RemoteFile) (int64, error) {
+	return b.CreateDirectoryContext(context.Background(), parent, name, attrs)
+}
+
+// Context variant of CreateDirectory.
+func (b *BoxBackup) CreateDirectoryContext(ctx context.Context, parent int64, name string, attrs *RemoteFile) (int64, error) {
+	if attrs == nil {
+		attrs = &RemoteFile{
+			UID:              uint32(os.Getuid()),
+			GID:              uint32(os.Getgid()),
+			mode:             os.ModeDir | 0o755,
+			ModificationTime: time.Now(),
+		}
+	}
+	if attrs.AttributesModTime.IsZero() {
+		attrs.AttributesModTime = attrs.ModificationTime
+	}
+
+	ef, err := b.writeFilename(name)
+	if err != nil {
+		return 0, err
+	}
+	// Attributes go as bbstored reads them, with their size first.
+	ea := new(bytes.Buffer)
+	if err := b.writeAttributes(ea, attrs); err != nil {
+		return 0, err
+	}
+
+	am := attrs.AttributesModTime.UnixNano() / 1000
+	b.stateMu.Lock()
+	createDir2 := !b.noCreateDir2
+	b.stateMu.Unlock()
+	if createDir2 {
+		p, err := b.ExecuteContext(ctx, &Operation{
+			Op: proto.CreateDirectory2{
+				ContainingDirectoryID: parent,
+				AttributesModTime:     am,
+				ModificationTime:      attrs.ModificationTime.UnixNano() / 1000,
+			},
+			Tail:   ef,
+			Stream: bytes.NewBuffer(ea.Bytes()),
+		})
+		if err == nil {
+			b.cache.forget(parent)
+			return p.(*proto.Success).ObjectID, nil
+		}
+		if !b.unknownCommand(ctx, err) {
+			return 0, fmt.Errorf("create directory failed: %w", err)
+		}
+		glg.Warnf("server does not support CreateDirectory2: %s", err)
+		b.stateMu.Lock()
+		b.noCreateDir2 = true
+		b.stateMu.Unlock()
+	}
+
+	p, err := b.ExecuteContext(ctx, &Operation{
+		Op: proto.CreateDirectory{
+			ContainingDirectoryID: parent,
+			AttributesModTime:     am,
+		},
+		Tail:   ef,
+		Stream: bytes.NewBuffer(ea.Bytes()),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("create directory failed: %w", err)
+	}
+	b.cache.forget(parent)
+	return p.(*proto.Success).ObjectID, nil
+}
+
+// Replaces the attributes of directory id, such as after its mode, owner or
+// extended attributes changed locally.
+func (b *BoxBackup) ChangeDirAttributes(id int64, attrs *RemoteFile) error {
+	return b.ChangeDirAttributesContext(context.Background(), id, attrs)
+}
+
+// Context variant of ChangeDirAttributes.
+func (b *BoxBackup) ChangeDirAttributesContext(ctx context.Context, id int64, attrs *RemoteFile) error {
+	if attrs.AttributesModTime.IsZero() {
+		attrs.AttributesModTime = attrs.ModificationTime
+	}
+	ea := new(bytes.Buffer)
+	if err := b.writeAttributes(ea, attrs); err != nil {
+		return err
+	}
+	if _, err := b.ExecuteContext(ctx, &Operation{
+		Op: proto.ChangeDirAttributes{
+			ObjectID:          id,
+			AttributesModTime: attrs.AttributesModTime.UnixNano() / 1000,
+		},
+		Stream: ea,
+	}); err != nil {
+		return fmt.Errorf("change directory attributes failed: %w", err)
+	}
+	b.forgetDir(id)
+	return nil
+}
+
+// Moves object id from one directory into another, giving it a new name.
+// Flags are a combination of proto.Flags_MoveAllWithSameName and
+// proto.Flags_AllowMoveOverDeletedObject.
+func (b *BoxBackup) MoveObject(id, fromDir, toDir int64, newName string, flags int32) error {
+	return b.MoveObjectContext(context.Background(), id, fromDir, toDir, newName, flags)
+}
+
+// Context variant of MoveObject.
+func (b *BoxBackup) MoveObjectContext(ctx context.Context, id, fromDir, toDir int64, newName string, flags int32) error {
+	ef, err := b.writeFilename(newName)
+	if err != nil {
+		return err
+	}
+	op := &Operation{
+		Op: proto.MoveObject{
+			ObjectID:          id,
+			MoveFromDirectory: fromDir,
+			MoveToDirectory:   toDir,
+			Flags:             flags,
+		},
+		Tail: ef,
+	}
+	if _, err := b.ExecuteContext(ctx, op); err != nil {
+		return fmt.Errorf("move object failed: %w", err)
+	}
+	b.cache.forgetEntry(id)
+	b.cache.forget(fromDir, toDir)
+	return nil
+}
+
 func (b *BoxBackup) StoreFile(d, m, a int64, fn string, fc []byte) error {
+	return b.StoreFileContext(context.Background(), d, m, a, fn, fc)
+}
+
+// Context variant of StoreFile.
+func (b *BoxBackup) StoreFileContext(ctx context.Context, d, m, a int64, fn string, fc []byte) error {
 	// First prepare the file stream
 	buf := new(bytes.Buffer)
 
 	fs := proto.FileStreamFormat{
-		MagicValue:        0x66696C65,
+		MagicValue:        proto.FileMagicV1,
 		NumBlocks:         1,
 		ContainerID:       d,
 		ModificationTime:  0,
@@ -218,7 +509,7 @@ func (b *BoxBackup) StoreFile(d, m, a int64, fn string, fc []byte) error {
 
 	// Send the file data right away, as in Storage format.
 	// Block index will come trailing
-	var bh uint8 = 0b10
+	var bh uint8 = proto.BlockEncodingAES << 1
 	binary.Write(buf, binary.BigEndian, &bh)
 
 	iv := make([]byte, 16)
@@ -232,7 +523,7 @@ func (b *BoxBackup) StoreFile(d, m, a int64, fn string, fc []byte) error {
 	// Block Index
 	bi := blockIndex{
 		Index: proto.FileBlockIndex{
-			MagicValue:  0x62696478,
+			MagicValue:  proto.BlockIndexMagicV1,
 			OtherFileID: 0,
 			NumBlocks:   1,
 		},
@@ -248,7 +539,7 @@ func (b *BoxBackup) StoreFile(d, m, a int64, fn string, fc []byte) error {
 	})
 	b.writeBlockIndex(buf, &bi)
 
-	_, err = b.Execute(&Operation{
+	_, err = b.ExecuteContext(ctx, &Operation{
 		Op: proto.StoreFile{
 			DirectoryObjectID: d,
 			ModificationTime:  m,
@@ -259,7 +550,8 @@ func (b *BoxBackup) StoreFile(d, m, a int64, fn string, fc []byte) error {
 		Stream: buf,
 	})
 	if err != nil {
-		return fmt.Errorf("get file failed: %q", err)
+		return fmt.Errorf("get file failed: %w", err)
 	}
+	b.cache.forget(d)
 	return nil
 }
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"bbq/crypto"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Creates crypto from a random keys file.
+func newTestCrypto(t *testing.T) *crypto.Crypto {
+	k := make([]byte, 1024)
+	rand.Read(k)
+	fn := filepath.Join(t.TempDir(), "keys.raw")
+	if err := ioutil.WriteFile(fn, k, 0600); err != nil {
+		t.Fatalf("Unable to write keys: %s", err)
+	}
+	cr, err := crypto.NewCrypto(fn)
+	if err != nil {
+		t.Fatalf("Unable to load crypto: %s", err)
+	}
+	return cr
+}
+
+// Returns a client connected to the server end of a pipe.
+func newTestSession(t *testing.T) (*BoxBackup, net.Conn) {
+	s, c := net.Pipe()
+	bb := NewBoxBackup(c, newTestCrypto(t))
+	bb.ready = true
+	t.Cleanup(func() {
+		s.Close()
+		c.Close()
+	})
+	return bb, s
+}
+
+// Receives a command on the server side, skipping the stream if one follows.
+func recvCommand(t *testing.T, s io.Reader, stream bool) interface{} {
+	var hdr proto.Header
+	if err := binary.Read(s, binary.BigEndian, &hdr); err != nil {
+		t.Errorf("Receiving command: %s", err)
+		return nil
+	}
+	op, ok := proto.GetCommand(hdr.Command)
+	if !ok {
+		t.Errorf("Unknown command: %+v", hdr)
+		return nil
+	}
+	buf := make([]byte, hdr.Size-uint32(binary.Size(hdr)))
+	io.ReadFull(s, buf)
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, op)
+
+	if stream {
+		binary.Read(s, binary.BigEndian, &hdr)
+		if hdr.Command != proto.STREAM_TYPE {
+			t.Errorf("Expected stream, got: %+v", hdr)
+		}
+		io.CopyN(ioutil.Discard, s, int64(hdr.Size))
+	}
+	return op
+}
+
+func TestCreateDirectoryFallback(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		if _, ok := recvCommand(t, s, true).(*proto.CreateDirectory2); !ok {
+			t.Errorf("Expected CreateDirectory2")
+		}
+		sendCommand(s, &Operation{Op: proto.Error{Type: 0, SubType: 1}})
+
+		if _, ok := recvCommand(t, s, true).(*proto.CreateDirectory); !ok {
+			t.Errorf("Expected CreateDirectory")
+		}
+		sendCommand(s, &Operation{Op: proto.Success{ObjectID: 42}})
+	}()
+
+	id, err := bb.CreateDirectory(1, "foo", &RemoteFile{mode: os.ModeDir | 0o700})
+	if err != nil {
+		t.Fatalf("CreateDirectory: %s", err)
+	}
+	<-done
+	if id != 42 {
+		t.Errorf("Expected directory 42, got %v", id)
+	}
+	if !bb.noCreateDir2 {
+		t.Errorf("CreateDirectory2 should be disabled after fallback")
+	}
+}
+
+func TestCreateDirectoryDropped(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	// Like bbstored, the server closes the connection on a command it does
+	// not know, and the session reconnects for the older one.
+	go func() {
+		if _, ok := recvCommand(t, s, true).(*proto.CreateDirectory2); !ok {
+			t.Errorf("Expected CreateDirectory2")
+		}
+		s.Close()
+	}()
+	bb.SetDialer(func() (net.Conn, error) {
+		s, c := net.Pipe()
+		t.Cleanup(func() { s.Close() })
+		go func() {
+			hs := make([]byte, proto.HandshakeLen)
+			if _, err := io.ReadFull(s, hs); err != nil {
+				return
+			}
+			s.Write(hs)
+			if _, ok := recvCommand(t, s, true).(*proto.CreateDirectory); !ok {
+				t.Errorf("Expected CreateDirectory")
+			}
+			sendCommand(s, &Operation{Op: proto.Success{ObjectID: 42}})
+		}()
+		return c, nil
+	})
+
+	id, err := bb.CreateDirectory(1, "foo", nil)
+	if err != nil {
+		t.Fatalf("CreateDirectory: %s", err)
+	}
+	if id != 42 {
+		t.Errorf("Expected directory 42, got %v", id)
+	}
+}
+
+func TestCreateDirectoryExists(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	go func() {
+		recvCommand(t, s, true)
+		sendCommand(s, &Operation{Op: proto.Error{Type: 1000, SubType: 8}})
+	}()
+
+	if _, err := bb.CreateDirectory(1, "foo", nil); !errors.Is(err, ErrDirectoryAlreadyExists) {
+		t.Errorf("Expected %v for existing directory, got %v", ErrDirectoryAlreadyExists, err)
+	}
+	if bb.noCreateDir2 {
+		t.Errorf("CreateDirectory2 should not be disabled by store errors")
+	}
+}
+
+func TestCreateDirectoryAttributes(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	go func() {
+		recvCommand(t, s, false)
+		var hdr proto.Header
+		binary.Read(s, binary.BigEndian, &hdr)
+		a := make([]byte, hdr.Size)
+		io.ReadFull(s, a)
+		// bbstored reads the attributes with StreamableMemBlock::Set, which
+		// expects their size first.
+		if len(a) < 4 || int(binary.BigEndian.Uint32(a)) != len(a)-4 {
+			t.Errorf("Attributes without their size: % x", a)
+		}
+		sendCommand(s, &Operation{Op: proto.Success{ObjectID: 42}})
+	}()
+
+	if _, err := bb.CreateDirectory(1, "foo", nil); err != nil {
+		t.Errorf("CreateDirectory: %s", err)
+	}
+}
+
+func TestDeleteUndelete(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	for _, tc := range []struct {
+		name  string
+		call  func() error
+		op    interface{} // expected command
+		reply interface{}
+		ok    bool
+	}{
+		{"delete file", func() error { return bb.DeleteFile(2, "notes.txt") },
+			&proto.DeleteFile{InDirectory: 2}, proto.Success{ObjectID: 10}, true},
+		{"delete missing file", func() error { return bb.DeleteFile(2, "other.txt") },
+			&proto.DeleteFile{InDirectory: 2}, proto.Success{}, false},
+		{"undelete file", func() error { return bb.UndeleteFile(2, 10) },
+			&proto.UndeleteFile{InDirectory: 2, ObjectID: 10}, proto.Success{ObjectID: 10}, true},
+		{"undelete missing file", func() error { return bb.UndeleteFile(2, 11) },
+			&proto.UndeleteFile{InDirectory: 2, ObjectID: 11}, proto.Success{}, false},
+		{"delete directory", func() error { return bb.DeleteDirectory(3) },
+			&proto.DeleteDirectory{ObjectID: 3}, proto.Success{ObjectID: 3}, true},
+		{"delete root", func() error { return bb.DeleteDirectory(1) },
+			&proto.DeleteDirectory{ObjectID: 1}, proto.Error{Type: 1000, SubType: 9}, false},
+		{"undelete directory", func() error { return bb.UndeleteDirectory(3) },
+			&proto.UndeleteDirectory{ObjectID: 3}, proto.Success{ObjectID: 3}, true},
+	} {
+		tc := tc
+		go func() {
+			op := recvCommand(t, s, false)
+			if !reflect.DeepEqual(op, tc.op) {
+				t.Errorf("%s: sent %+v, want %+v", tc.name, op, tc.op)
+			}
+			sendCommand(s, &Operation{Op: tc.reply})
+		}()
+		if err := tc.call(); (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v", tc.name, err)
+		}
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	// A command waiting for a busy session gives up, leaving it usable.
+	if err := bb.lock(context.Background()); err != nil {
+		t.Fatalf("lock: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err := bb.ExecuteContext(ctx, &Operation{Op: proto.GetIsAlive{}})
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Waiting for the session: %v, want deadline exceeded", err)
+	}
+	bb.unlock()
+	if err := bb.Broken(); err != nil {
+		t.Errorf("Session broken after waiting: %s", err)
+	}
+
+	// A server which stops replying breaks the session.
+	go recvCommand(t, s, false)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = bb.ExecuteContext(ctx, &Operation{Op: proto.GetIsAlive{}})
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Waiting for the reply: %v, want deadline exceeded", err)
+	}
+	if _, err := bb.Execute(&Operation{Op: proto.GetIsAlive{}}); !errors.Is(err, ErrSessionBroken) {
+		t.Errorf("Command on a broken session: %v, want %v", err, ErrSessionBroken)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	go func() {
+		recvCommand(t, s, false)
+		sendCommand(s, &Operation{Op: proto.Error{Type: 1000, SubType: 7}})
+		recvCommand(t, s, false)
+		sendCommand(s, &Operation{Op: proto.Error{Type: 0, SubType: 3}})
+	}()
+
+	err := bb.DeleteDirectory(5)
+	if !errors.Is(err, ErrDoesNotExist) || errors.Is(err, ErrTargetNameExists) {
+		t.Errorf("Expected %v, got %v", ErrDoesNotExist, err)
+	}
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || !pe.Store() || pe.SubType != 7 {
+		t.Errorf("Expected store error 7, got %#v", pe)
+	}
+
+	err = bb.DeleteDirectory(5)
+	if !errors.As(err, &pe) || pe.Store() || pe.SubType != 3 {
+		t.Errorf("Expected unknown error 3, got %v", err)
+	}
+	if sessionError(err) || !sessionError(ErrStorageLimitExceeded) {
+		t.Errorf("Wrong session errors")
+	}
+}
@@ -0,0 +1,237 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Kinds of differences found by Compare.
+const (
+	DiffMissingRemote = "missing-remote" // exists only locally
+	DiffMissingLocal  = "missing-local"  // exists only in the store
+	DiffType          = "type"
+	DiffSize          = "size"
+	DiffModTime       = "mtime"
+	DiffMode          = "mode"
+	DiffOwner         = "owner"
+	DiffSymlink       = "symlink"
+	DiffContents      = "contents"
+	DiffError         = "error" // entry could not be compared
+)
+
+// CompareOptions control how deep Compare looks.
+type CompareOptions struct {
+	// Download the files and compare their contents as well.
+	Deep bool
+	// Called for each difference found.
+	Progress func(d CompareDifference)
+}
+
+// Difference between a local entry and the stored one.
+type CompareDifference struct {
+	Path   string `json:"path"` // local path
+	Kind   string `json:"kind"`
+	Local  string `json:"local,omitempty"`
+	Remote string `json:"remote,omitempty"`
+}
+
+// CompareReport lists the differences found by Compare.
+type CompareReport struct {
+	Files       int64               `json:"files"`
+	Directories int64               `json:"directories"`
+	Differences []CompareDifference `json:"differences"`
+}
+
+// Returns whether the trees are the same.
+func (r *CompareReport) OK() bool {
+	return len(r.Differences) == 0
+}
+
+type comparer struct {
+	b    *BoxBackup
+	opts *CompareOptions
+	r    *CompareReport
+}
+
+// Compares the local directory with remote directory id, like bbackupquery
+// compare does. Entries missing on either side are reported, as are
+// differences in type, size, modification time, mode, ownership and symlink
+// target. Directory modification times are not compared, as they change with
+// their contents. Sizes are taken from the block index of each file, unless
+// the contents are compared as well.
+func (b *BoxBackup) Compare(local string, id int64, opts *CompareOptions) (*CompareReport, error) {
+	if opts == nil {
+		opts = &CompareOptions{}
+	}
+	fi, err := os.Stat(local)
+	if err != nil {
+		return nil, fmt.Errorf("compare: %v", err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("compare: %s is not a directory", local)
+	}
+	c := &comparer{
+		b:    b,
+		opts: opts,
+		r: &CompareReport{
+			Differences: []CompareDifference{},
+		},
+	}
+	c.compareDir(local, id)
+	return c.r, nil
+}
+
+func (c *comparer) diff(p, kind string, l, r interface{}) {
+	d := CompareDifference{
+		Path: p,
+		Kind: kind,
+	}
+	if l != nil {
+		d.Local = fmt.Sprint(l)
+	}
+	if r != nil {
+		d.Remote = fmt.Sprint(r)
+	}
+	c.r.Differences = append(c.r.Differences, d)
+	if c.opts.Progress != nil {
+		c.opts.Progress(d)
+	}
+}
+
+func (c *comparer) compareDir(local string, id int64) {
+	c.r.Directories++
+	de, err := c.b.ReadDir(id)
+	if err != nil {
+		c.diff(local, DiffError, nil, err)
+		return
+	}
+	remote := make(map[string]*RemoteFile)
+	for _, e := range de {
+		if e.Flags&(proto.Flags_Deleted|proto.Flags_OldVersion) == 0 {
+			remote[e.Name()] = e
+		}
+	}
+
+	files, err := ioutil.ReadDir(local)
+	if err != nil {
+		c.diff(local, DiffError, err, nil)
+		return
+	}
+	seen := make(map[string]bool)
+	for _, fi := range files {
+		p := filepath.Join(local, fi.Name())
+		seen[fi.Name()] = true
+		e, ok := remote[fi.Name()]
+		if !ok {
+			c.diff(p, DiffMissingRemote, fi.Mode(), nil)
+			continue
+		}
+		if fi.Mode().Type() != e.Mode().Type() {
+			c.diff(p, DiffType, fi.Mode().Type(), e.Mode().Type())
+			continue
+		}
+		c.compareAttributes(p, fi, e)
+		if fi.IsDir() {
+			c.compareDir(p, e.Id)
+		}
+	}
+
+	for _, e := range de {
+		if !seen[e.Name()] && remote[e.Name()] == e {
+			c.diff(filepath.Join(local, e.Name()), DiffMissingLocal, nil, e.Mode())
+		}
+	}
+}
+
+func (c *comparer) compareAttributes(p string, fi os.FileInfo, e *RemoteFile) {
+	if fi.Mode().Perm() != e.mode.Perm() {
+		c.diff(p, DiffMode, fi.Mode().Perm(), e.mode.Perm())
+	}
+	if uid, gid := fileOwner(fi); uid != e.UID || gid != e.GID {
+		c.diff(p, DiffOwner, fmt.Sprintf("%v:%v", uid, gid), fmt.Sprintf("%v:%v", e.UID, e.GID))
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		t, err := os.Readlink(p)
+		if err != nil {
+			c.diff(p, DiffError, err, nil)
+		} else if t != e.Symlink {
+			c.diff(p, DiffSymlink, t, e.Symlink)
+		}
+
+	case fi.Mode().IsRegular():
+		c.r.Files++
+		if fi.ModTime().Unix() != e.ModificationTime.Unix() {
+			c.diff(p, DiffModTime, fi.ModTime(), e.ModificationTime)
+		}
+		if c.opts.Deep {
+			c.compareContents(p, fi, e)
+			return
+		}
+		idx, err := c.b.blockIndexByID(context.Background(), e.Id)
+		if err != nil {
+			c.diff(p, DiffError, nil, err)
+			return
+		}
+		var s int64
+		for _, blk := range idx.Blocks {
+			s += int64(blk.Size)
+		}
+		if s != fi.Size() {
+			c.diff(p, DiffSize, fi.Size(), s)
+		}
+	}
+}
+
+func (c *comparer) compareContents(p string, fi os.FileInfo, e *RemoteFile) {
+	f, err := os.Open(p)
+	if err != nil {
+		c.diff(p, DiffError, err, nil)
+		return
+	}
+	defer f.Close()
+	rf, err := c.b.OpenFile(e.ParentId, e.Id)
+	if err != nil {
+		c.diff(p, DiffError, nil, err)
+		return
+	}
+	defer rf.Close()
+
+	lb := make([]byte, 64*1024)
+	rb := make([]byte, len(lb))
+	var off int64
+	for {
+		ln, lerr := io.ReadFull(f, lb)
+		rn, rerr := io.ReadFull(rf, rb)
+		if lerr != nil && lerr != io.EOF && lerr != io.ErrUnexpectedEOF {
+			c.diff(p, DiffError, lerr, nil)
+			return
+		}
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			c.diff(p, DiffError, nil, rerr)
+			return
+		}
+		if ln != rn {
+			// Count the rest to report both sizes.
+			l, _ := io.Copy(ioutil.Discard, f)
+			r, _ := io.Copy(ioutil.Discard, rf)
+			c.diff(p, DiffSize, off+int64(ln)+l, off+int64(rn)+r)
+			return
+		}
+		if !bytes.Equal(lb[:ln], rb[:rn]) {
+			c.diff(p, DiffContents, nil, nil)
+			return
+		}
+		if ln < len(lb) {
+			return
+		}
+		off += int64(ln)
+	}
+}
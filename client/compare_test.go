@@ -0,0 +1,71 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	bb, ts := newTestStore(t)
+	dir := t.TempDir()
+
+	// Local file and the stored one with the same attributes.
+	add := func(parent, id int64, name, local, remote string) *RemoteFile {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(local), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		e := ts.addFile(parent, id, filepath.Base(name), []byte(remote))
+		os.Chtimes(p, e.ModificationTime, e.ModificationTime)
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.SetAttributes(fi)
+		return e
+	}
+	add(1, 2, "same", "hello", "hello")
+	add(1, 3, "changed", "world", "wordl")
+	add(1, 4, "size", "abc", "abcd")
+	add(1, 5, "mode", "x", "x").mode = 0o600
+	ioutil.WriteFile(filepath.Join(dir, "local-only"), nil, 0o644)
+	ts.addFile(1, 6, "remote-only", []byte("x"))
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	fi, _ := os.Stat(filepath.Join(dir, "sub"))
+	ts.addDir(1, 7, "sub").SetAttributes(fi)
+	add(7, 8, "sub/deep", "x", "x").ModificationTime = fi.ModTime().Add(-3600e9)
+
+	kinds := func(r *CompareReport) string {
+		var k []string
+		for _, d := range r.Differences {
+			k = append(k, filepath.Base(d.Path)+":"+d.Kind)
+		}
+		sort.Strings(k)
+		return strings.Join(k, " ")
+	}
+
+	r, err := bb.Compare(dir, 1, nil)
+	if err != nil {
+		t.Fatalf("Compare: %s", err)
+	}
+	want := "deep:mtime local-only:missing-remote mode:mode remote-only:missing-local size:size"
+	if k := kinds(r); k != want {
+		t.Errorf("Compare found %q, want %q", k, want)
+	}
+	if r.Files != 5 || r.Directories != 2 {
+		t.Errorf("Compared %v files in %v directories", r.Files, r.Directories)
+	}
+
+	r, err = bb.Compare(dir, 1, &CompareOptions{Deep: true})
+	if err != nil {
+		t.Fatalf("Deep compare: %s", err)
+	}
+	want = "changed:contents deep:mtime local-only:missing-remote mode:mode remote-only:missing-local size:size"
+	if k := kinds(r); k != want {
+		t.Errorf("Deep compare found %q, want %q", k, want)
+	}
+}
@@ -5,23 +5,63 @@ import (
 	"bbq/crypto"
 	"bufio"
 	"bytes"
+	"context"
+	"encoding"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/kpango/glg"
 )
 
+// BoxBackup is a session with the store. It can be used from several
+// goroutines, but commands run one at a time: a command waits until the reply
+// to the previous one, and the stream following it, has been read or closed.
+// See Pool for running commands in parallel.
+//
+// Methods taking a context stop waiting when it is done. A command cut off
+// in the middle of its exchange leaves the session broken, after which all
+// commands fail with ErrSessionBroken, unless the session can reconnect, see
+// SetDialer.
 type BoxBackup struct {
 	conn  net.Conn
 	crypt *crypto.Crypto
 	ready bool
-	/*
-		version    uint32
-		user       uint32
-	*/
+	// Held from sending a command until its reply and stream are read.
+	sem chan struct{}
+	// Context of the running command and the function to stop watching it.
+	ctx     context.Context
+	unwatch func()
+	// Reply was followed by a stream, which GetStream has not returned yet.
+	streamPending bool
+
+	stateMu sync.Mutex // guards the fields below
+	// Server does not understand CreateDirectory2.
+	noCreateDir2 bool
+	// Why the session can not be used anymore.
+	broken error
+	// Opens a new connection for reconnecting.
+	dial func() (net.Conn, error)
+	// Protocol version and login to repeat after reconnecting.
+	version int32
+	login   *proto.Login
+
+	aliveMu sync.Mutex // guards the keepalive state below
+	// When the last command was sent.
+	lastUsed time.Time
+	// Stream of a reply is being read, more commands can be queued behind it.
+	streaming bool
+	// Replies to GetIsAlive queued behind the stream.
+	aliveOwed int
+	// Stops the keepalive, see KeepAlive.
+	stopAlive chan struct{}
+
+	cache *dirCache
 }
 
 type Operation struct {
@@ -35,6 +75,8 @@ func NewBoxBackup(srv net.Conn, crypt *crypto.Crypto) *BoxBackup {
 		conn:  srv,
 		crypt: crypt,
 		ready: false,
+		sem:   make(chan struct{}, 1),
+		cache: newDirCache(),
 	}
 }
 
@@ -64,22 +106,38 @@ func sendCommand(c io.Writer, op *Operation) (uint32, error) {
 		return 0, fmt.Errorf("unknown command %v", t)
 	}
 
+	// Commands with fields of variable length encode themselves.
+	var data []byte
+	if m, ok := op.Op.(encoding.BinaryMarshaler); ok {
+		d, err := m.MarshalBinary()
+		if err != nil {
+			return 0, err
+		}
+		data = d
+	} else {
+		d := new(bytes.Buffer)
+		if err := binary.Write(d, binary.BigEndian, op.Op); err != nil {
+			return 0, err
+		}
+		data = d.Bytes()
+	}
+
 	hdr := proto.Header{
 		Command: cmd[0],
 	}
-	hdr.Size = uint32(binary.Size(hdr) + binary.Size(op.Op) + len(op.Tail))
+	hdr.Size = uint32(binary.Size(hdr) + len(data) + len(op.Tail))
 
-	if err := binary.Write(c, binary.BigEndian, hdr); err != nil {
+	// Sent with a single write, commands without fields included.
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, hdr); err != nil {
 		return 0, err
 	}
-	if err := binary.Write(c, binary.BigEndian, op.Op); err != nil {
+	buf.Write(data)
+	buf.Write(op.Tail)
+	if _, err := buf.WriteTo(c); err != nil {
 		return 0, err
 	}
 	glg.Infof("sent hdr: %+v", hdr)
-
-	if op.Tail != nil {
-		c.Write(op.Tail)
-	}
 	return cmd[1], nil
 }
 
@@ -101,10 +159,17 @@ func getResponse(r io.Reader, exp uint32) (interface{}, error) {
 
 	// Get the full response into buffer
 	buf := make([]byte, hdr.Size-uint32(binary.Size(hdr)))
-	if n, err := io.ReadFull(r, buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return nil, err
-	} else if n != binary.Size(resp) {
-		glg.Warnf("Warning: extra bytes sent by server: %v vs. %v", n, binary.Size(resp))
+	}
+	if u, ok := resp.(encoding.BinaryUnmarshaler); ok {
+		if err := u.UnmarshalBinary(buf); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+	if len(buf) != binary.Size(resp) {
+		glg.Warnf("Warning: extra bytes sent by server: %v vs. %v", len(buf), binary.Size(resp))
 	}
 
 	// Parse the response from buffer
@@ -114,48 +179,176 @@ func getResponse(r io.Reader, exp uint32) (interface{}, error) {
 	return resp, nil
 }
 
+// Returns the error reply of the server as a *ProtocolError.
 func (b *BoxBackup) HandleError(ret *proto.Error) error {
-	var errorSubtype = []string{
-		"Success",
-		"WrongVersion",              // 1
-		"NotInRightProtocolPhase",   // 2
-		"BadLogin",                  // 3
-		"CannotLockStoreForWriting", // 4
-		"SessionReadOnly",           // 5
-		"FileDoesNotVerify",         // 6
-		"DoesNotExist",              // 7
-		"DirectoryAlreadyExists",    // 8
-		"CannotDeleteRoot",          // 9
-		"TargetNameExists",          // 10
-		"StorageLimitExceeded",      // 11
-		"DiffFromFileDoesNotExist",  // 12
-		"DoesNotExistInDirectory",   // 13
-		"PatchConsistencyError",     // 14
-		"MultiplyReferencedObject",  // 15
-		"DisabledAccount",           // 16
-	}
 	glg.Error(ret)
-	if ret.Type == 1000 && int(ret.SubType) > 0 && int(ret.SubType) < len(errorSubtype) {
-		return fmt.Errorf("error: %s", errorSubtype[ret.SubType])
+	return &ProtocolError{Type: ret.Type, SubType: ret.SubType}
+}
+
+// Replies followed by a stream, by command. The stream has to be read with
+// GetStream before the session can run another command.
+var streamFollows = map[string]func(r interface{}) bool{
+	"proto.ListDirectory":     always,
+	"proto.GetFile":           always,
+	"proto.GetObject":         always,
+	"proto.GetBlockIndexByID": always,
+	"proto.GetObjectName": func(r interface{}) bool {
+		o, ok := r.(*proto.ObjectName)
+		return ok && o.NumNameElements != 0
+	},
+	"proto.GetBlockIndexByName": func(r interface{}) bool {
+		s, ok := r.(*proto.Success)
+		return ok && s.ObjectID != 0
+	},
+}
+
+func always(interface{}) bool {
+	return true
+}
+
+// Session was cut off in the middle of an exchange with the server.
+var ErrSessionBroken = errors.New("session broken")
+
+// Returns why the session can not be used anymore, or nil.
+func (b *BoxBackup) Broken() error {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+	return b.broken
+}
+
+// Closes the connection without logging out, such as for a broken session.
+func (b *BoxBackup) Close() error {
+	b.KeepAlive(0)
+	return b.conn.Close()
+}
+
+// Marks the session broken after a failed exchange, returns the error.
+func (b *BoxBackup) fail(err error) error {
+	if ctx := b.ctx; ctx != nil {
+		cerr := ctx.Err()
+		// The connection deadline can pass just before the context notices.
+		if d, ok := ctx.Deadline(); ok && cerr == nil && !time.Now().Before(d) {
+			cerr = context.DeadlineExceeded
+		}
+		if cerr != nil {
+			err = fmt.Errorf("%w: %v", cerr, err)
+		}
+	}
+	b.stateMu.Lock()
+	if b.broken == nil {
+		b.broken = fmt.Errorf("%w: %v", ErrSessionBroken, err)
+		glg.Errorf("Session broken: %s", err)
 	}
+	b.stateMu.Unlock()
+	return err
+}
 
-	return fmt.Errorf("unknown error: (%v, %v)", ret.Type, ret.SubType)
+// Reserves the session for a command, waiting for the previous one to finish.
+func (b *BoxBackup) lock(ctx context.Context) error {
+	select {
+	case b.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return b.prepare(ctx)
+}
+
+// Readies the session reserved by the caller for a command. A broken session
+// is reconnected first, when it has a dialer. Releases it on failure.
+func (b *BoxBackup) prepare(ctx context.Context) error {
+	if err := b.Broken(); err != nil {
+		if b.dial == nil {
+			<-b.sem
+			return err
+		}
+		if err := b.redial(ctx); err != nil {
+			<-b.sem
+			return fmt.Errorf("%w: %v", ErrSessionBroken, err)
+		}
+	}
+	b.ctx = ctx
+	b.unwatch = b.watch(ctx)
+	b.aliveMu.Lock()
+	b.lastUsed = time.Now()
+	b.aliveMu.Unlock()
+	return nil
+}
+
+func (b *BoxBackup) unlock() {
+	b.unwatch()
+	b.ctx = nil
+	<-b.sem
+}
+
+// Applies the deadline of the context to the connection and interrupts
+// blocked reads and writes when it is canceled, until the returned function
+// is called.
+func (b *BoxBackup) watch(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	d, _ := ctx.Deadline()
+	b.conn.SetDeadline(d)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			b.conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		b.conn.SetDeadline(time.Time{})
+	}
 }
 
 // Takes one of the structures defined in proto.go and writes them to the wire,
 // gets reponse from the server and packs it into an appropriate struct.
+//
+// When a stream follows the reply, the session stays reserved for the caller
+// until the stream from GetStream is read to its end or closed.
 func (b *BoxBackup) Execute(op *Operation) (interface{}, error) {
+	return b.ExecuteContext(context.Background(), op)
+}
 
+// Runs a command like Execute, giving up when the context is done. A stream
+// following the reply is read under the same context.
+func (b *BoxBackup) ExecuteContext(ctx context.Context, op *Operation) (interface{}, error) {
+	if err := b.lock(ctx); err != nil {
+		return nil, err
+	}
+	r, err := b.execute(op)
+	for n := 0; err != nil && b.retry(ctx, op, n); n++ {
+		r, err = b.execute(op)
+	}
+	if err == nil {
+		if f, ok := streamFollows[reflect.TypeOf(op.Op).String()]; ok && f(r) {
+			b.streamPending = true
+			b.aliveMu.Lock()
+			b.streaming = true
+			b.aliveMu.Unlock()
+			return r, nil
+		}
+	}
+	b.unlock()
+	return r, err
+}
+
+func (b *BoxBackup) execute(op *Operation) (interface{}, error) {
 	if !b.ready {
 		if err := handshake(b.conn); err != nil {
-			return nil, err
+			return nil, b.fail(err)
 		}
 		b.ready = true
 	}
 
 	exp, err := sendCommand(b.conn, op)
 	if err != nil {
-		return nil, err
+		return nil, b.fail(err)
 	}
 
 	if op.Stream != nil {
@@ -165,14 +358,18 @@ func (b *BoxBackup) Execute(op *Operation) (interface{}, error) {
 		}
 		//hdr.Size = uint32(binary.Size(hdr) + len(op.Stream))
 		hdr.Size = uint32(op.Stream.Len())
-		binary.Write(b.conn, binary.BigEndian, &hdr)
-		op.Stream.WriteTo(b.conn)
+		if err := binary.Write(b.conn, binary.BigEndian, &hdr); err != nil {
+			return nil, b.fail(err)
+		}
+		if _, err := op.Stream.WriteTo(b.conn); err != nil {
+			return nil, b.fail(err)
+		}
 	}
 
 	// Read back the response header
 	r, err := getResponse(b.conn, exp)
 	if err != nil {
-		return nil, err
+		return nil, b.fail(err)
 	}
 
 	switch p := r.(type) {
@@ -180,19 +377,35 @@ func (b *BoxBackup) Execute(op *Operation) (interface{}, error) {
 		glg.Infof("Operation Successful: %+v", r)
 
 	case *proto.Error:
-		return nil, fmt.Errorf("Operation failed: %s", b.HandleError(p))
+		return nil, fmt.Errorf("Operation failed: %w", b.HandleError(p))
 	}
 	return r, nil
 }
 
+// Returns the stream following the reply of the last command. Reading it to
+// the end, or closing it, lets the session run the next command.
 func (b *BoxBackup) GetStream() (*Stream, error) {
+	release := func() {}
+	fail := func(err error) error { return err }
+	if b.streamPending {
+		b.streamPending = false
+		var once sync.Once
+		release = func() {
+			once.Do(b.endStream)
+		}
+		fail = b.fail
+	}
+
 	glg.Debug("reading stream")
 	var hdr proto.Header
 	if err := binary.Read(b.conn, binary.BigEndian, &hdr); err != nil {
+		err = fail(err)
+		release()
 		return nil, err
 	}
 
 	if hdr.Command != proto.STREAM_TYPE {
+		release()
 		return nil, fmt.Errorf("No stream available")
 	}
 
@@ -207,8 +420,14 @@ func (b *BoxBackup) GetStream() (*Stream, error) {
 		}
 		st.Reader = bytes.NewReader(st.Buffer)
 	*/
-	return &Stream{
-		size:   hdr.Size,
-		reader: bufio.NewReader(b.conn),
-	}, nil
+	s := &Stream{
+		size:    hdr.Size,
+		reader:  bufio.NewReader(b.conn),
+		release: release,
+		fail:    fail,
+	}
+	if s.size == 0 {
+		release()
+	}
+	return s, nil
 }
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"crypto/md5"
+	"sort"
+)
+
+// Number of most common block sizes of the old file searched for, the same
+// limit bbackupd uses.
+const maxDiffBlockSizes = 64
+
+// Block of a file being uploaded. It either carries new data or refers to a
+// block of the file it is diffed from.
+type diffBlock struct {
+	data  []byte
+	ref   int64 // block number in the other file, if data is nil
+	entry proto.FileBlockIndexEntry
+}
+
+func newDiffBlock(data []byte) diffBlock {
+	return diffBlock{
+		data: data,
+		entry: proto.FileBlockIndexEntry{
+			Size:           int32(len(data)), // decrypted size
+			WeakChecksum:   calcRollingChecksum(data),
+			StrongChecksum: md5.Sum(data),
+		},
+	}
+}
+
+// Splits new data into blocks of at most max bytes.
+func appendDiffData(r []diffBlock, data []byte, max int) []diffBlock {
+	for len(data) > 0 {
+		n := len(data)
+		if n > max {
+			n = max
+		}
+		r = append(r, newDiffBlock(data[:n]))
+		data = data[n:]
+	}
+	return r
+}
+
+// Finds blocks of the old file in data, using the weak rolling checksum to
+// find candidates and MD5 to confirm them. Data between the matching blocks
+// is split into new blocks of the most common old block size. Returns nil if
+// no blocks match.
+func matchBlocks(data []byte, old *blockIndex) []diffBlock {
+	weak := make(map[int]map[uint32][]int64)
+	count := make(map[int]int)
+	for i, e := range old.Blocks {
+		s := int(e.Size)
+		if old.Sizes[i] <= 0 || s <= 0 || s > len(data) {
+			continue
+		}
+		if weak[s] == nil {
+			weak[s] = make(map[uint32][]int64)
+		}
+		weak[s][e.WeakChecksum] = append(weak[s][e.WeakChecksum], int64(i))
+		count[s]++
+	}
+	if len(count) == 0 {
+		return nil
+	}
+
+	var sizes []int
+	for s := range count {
+		sizes = append(sizes, s)
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		if count[sizes[i]] == count[sizes[j]] {
+			return sizes[i] > sizes[j]
+		}
+		return count[sizes[i]] > count[sizes[j]]
+	})
+	if len(sizes) > maxDiffBlockSizes {
+		sizes = sizes[:maxDiffBlockSizes]
+	}
+
+	// Offsets in data with a matching block, larger blocks win.
+	matches := make(map[int]diffBlock)
+	for _, s := range sizes {
+		var a, b uint16
+		rolling := false
+		for pos := 0; pos+s <= len(data); {
+			if !rolling {
+				w := calcRollingChecksum(data[pos : pos+s])
+				a, b = uint16(w), uint16(w>>16)
+				rolling = true
+			}
+			if nums, ok := weak[s][uint32(b)<<16|uint32(a)]; ok {
+				sum := md5.Sum(data[pos : pos+s])
+				found := false
+				for _, n := range nums {
+					if old.Blocks[n].StrongChecksum != sum {
+						continue
+					}
+					if m, ok := matches[pos]; !ok || int(m.entry.Size) < s {
+						matches[pos] = diffBlock{ref: n, entry: old.Blocks[n]}
+					}
+					found = true
+					break
+				}
+				if found {
+					// Start over after the matched block.
+					pos += s
+					rolling = false
+					continue
+				}
+			}
+			if pos+s < len(data) {
+				out, in := uint16(data[pos]), uint16(data[pos+s])
+				a = a - out + in
+				b = b - uint16(s)*out + a
+			}
+			pos++
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+
+	var offs []int
+	for o := range matches {
+		offs = append(offs, o)
+	}
+	sort.Ints(offs)
+
+	var r []diffBlock
+	pos := 0
+	for _, o := range offs {
+		if o < pos {
+			continue
+		}
+		r = appendDiffData(r, data[pos:o], sizes[0])
+		r = append(r, matches[o])
+		pos = o + int(matches[o].entry.Size)
+	}
+	return appendDiffData(r, data[pos:], sizes[0])
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+// Builds a block index for data split into blocks of size s.
+func testBlockIndex(data []byte, s int) *blockIndex {
+	bi := &blockIndex{}
+	for i := 0; i < len(data); i += s {
+		e := i + s
+		if e > len(data) {
+			e = len(data)
+		}
+		b := newDiffBlock(data[i:e])
+		bi.Sizes = append(bi.Sizes, int64(e-i+1))
+		bi.Blocks = append(bi.Blocks, b.entry)
+	}
+	bi.Index.NumBlocks = int64(len(bi.Blocks))
+	return bi
+}
+
+func TestMatchBlocks(t *testing.T) {
+	old := make([]byte, 4*4096)
+	rand.Read(old)
+	bi := testBlockIndex(old, 4096)
+
+	// Change the second block, shift the rest and append some data.
+	data := append([]byte{}, old[:4096]...)
+	data = append(data, []byte("changed")...)
+	data = append(data, old[2*4096:]...)
+	data = append(data, []byte("more")...)
+
+	d := matchBlocks(data, bi)
+	if d == nil {
+		t.Fatalf("No blocks matched")
+	}
+
+	var refs []int64
+	var out []byte
+	for _, b := range d {
+		if b.data == nil {
+			refs = append(refs, b.ref)
+			out = append(out, old[b.ref*4096:(b.ref+1)*4096]...)
+		} else {
+			out = append(out, b.data...)
+		}
+	}
+	if len(refs) != 3 || refs[0] != 0 || refs[1] != 2 || refs[2] != 3 {
+		t.Errorf("Unexpected block references: %v", refs)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("Reassembled data does not match")
+	}
+
+	other := make([]byte, 8192)
+	rand.Read(other)
+	if d := matchBlocks(other, bi); d != nil {
+		t.Errorf("Unexpected match in unrelated data")
+	}
+}
+
+func TestCommitDiff(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	old := make([]byte, 3*4096)
+	rand.Read(old)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		recvCommand(t, s, false)
+		sendCommand(s, &Operation{Op: proto.Success{ObjectID: 7}})
+
+		buf := new(bytes.Buffer)
+		bi := testBlockIndex(old, 4096)
+		bi.Index.MagicValue = 0x62696478
+		bb.writeBlockIndex(buf, bi)
+		binary.Write(s, binary.BigEndian, &proto.Header{
+			Size:    uint32(buf.Len()),
+			Command: proto.STREAM_TYPE,
+		})
+		buf.WriteTo(s)
+
+		st, ok := recvCommand(t, s, true).(*proto.StoreFile)
+		if !ok {
+			t.Errorf("Expected StoreFile")
+		} else if st.DiffFromFileID != 7 {
+			t.Errorf("Expected diff from 7, got %v", st.DiffFromFileID)
+		}
+		sendCommand(s, &Operation{Op: proto.Success{ObjectID: 8}})
+	}()
+
+	f, err := bb.CreateFile(1, "test")
+	if err != nil {
+		t.Fatalf("CreateFile: %s", err)
+	}
+	f.Write(old)
+	f.Write([]byte("appended"))
+	if err := f.Commit(); err != nil {
+		t.Errorf("Commit: %s", err)
+	}
+	<-done
+}
+
+func TestCommitDiffStore(t *testing.T) {
+	bb, ts := newTestStore(t)
+	old := make([]byte, 8*1024)
+	rand.Read(old)
+	ts.addFile(1, 10, "f", old)
+
+	data := append(append([]byte{}, old...), "appended"...)
+	copy(data[3000:], "changed in the middle")
+	f, err := bb.CreateFile(1, "f")
+	if err != nil {
+		t.Fatalf("CreateFile: %s", err)
+	}
+	f.Write(data)
+	if err := f.Commit(); err != nil {
+		t.Fatalf("Commit: %s", err)
+	}
+
+	de, err := bb.ReadDir(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := Versions(de, "f")
+	if len(v) != 2 || v[0].Flags&proto.Flags_OldVersion != 0 {
+		t.Fatalf("Versions of f: %v, want the upload as the current one", len(v))
+	}
+	bi := ts.uploaded[v[0].Id]
+	refs := 0
+	for _, s := range bi.Sizes {
+		if s <= 0 {
+			refs++
+		}
+	}
+	if bi.Index.OtherFileID != 10 || refs == 0 {
+		t.Errorf("Uploaded %v blocks referring to %x, want a diff from 10", refs, bi.Index.OtherFileID)
+	}
+
+	rf, err := bb.OpenFile(1, v[0].Id)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer rf.Close()
+	got, err := ioutil.ReadAll(rf)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Read back %v bytes, %v", len(got), err)
+	}
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Type of the errors the store reports about requests.
+const storeErrorType = 1000
+
+// ProtocolError is an error reply of the server. Store errors can be checked
+// with errors.Is against the Err values below, such as ErrDoesNotExist.
+type ProtocolError struct {
+	Type    int32
+	SubType int32
+}
+
+// Names of the store errors by subtype.
+var storeErrorNames = []string{
+	"Success",
+	"WrongVersion",              // 1
+	"NotInRightProtocolPhase",   // 2
+	"BadLogin",                  // 3
+	"CannotLockStoreForWriting", // 4
+	"SessionReadOnly",           // 5
+	"FileDoesNotVerify",         // 6
+	"DoesNotExist",              // 7
+	"DirectoryAlreadyExists",    // 8
+	"CannotDeleteRoot",          // 9
+	"TargetNameExists",          // 10
+	"StorageLimitExceeded",      // 11
+	"DiffFromFileDoesNotExist",  // 12
+	"DoesNotExistInDirectory",   // 13
+	"PatchConsistencyError",     // 14
+	"MultiplyReferencedObject",  // 15
+	"DisabledAccount",           // 16
+}
+
+func storeError(subType int32) *ProtocolError {
+	return &ProtocolError{Type: storeErrorType, SubType: subType}
+}
+
+// Store errors, see ProtocolError.
+var (
+	ErrWrongVersion              = storeError(1)
+	ErrNotInRightProtocolPhase   = storeError(2)
+	ErrBadLogin                  = storeError(3)
+	ErrCannotLockStoreForWriting = storeError(4)
+	ErrSessionReadOnly           = storeError(5)
+	ErrFileDoesNotVerify         = storeError(6)
+	ErrDoesNotExist              = storeError(7)
+	ErrDirectoryAlreadyExists    = storeError(8)
+	ErrCannotDeleteRoot          = storeError(9)
+	ErrTargetNameExists          = storeError(10)
+	ErrStorageLimitExceeded      = storeError(11)
+	ErrDiffFromFileDoesNotExist  = storeError(12)
+	ErrDoesNotExistInDirectory   = storeError(13)
+	ErrPatchConsistencyError     = storeError(14)
+	ErrMultiplyReferencedObject  = storeError(15)
+	ErrDisabledAccount           = storeError(16)
+)
+
+func (e *ProtocolError) Error() string {
+	if e.Store() && e.SubType > 0 && int(e.SubType) < len(storeErrorNames) {
+		return "error: " + storeErrorNames[e.SubType]
+	}
+	return fmt.Sprintf("unknown error: (%v, %v)", e.Type, e.SubType)
+}
+
+// Matches other protocol errors with the same type and subtype.
+func (e *ProtocolError) Is(target error) bool {
+	t, ok := target.(*ProtocolError)
+	return ok && t.Type == e.Type && t.SubType == e.SubType
+}
+
+// Returns whether this is an error of the store, rather than a reply to a
+// command the server does not implement.
+func (e *ProtocolError) Store() bool {
+	return e.Type == storeErrorType
+}
+
+// Returns whether err concerns the whole session rather than a single object,
+// so that later commands would fail as well.
+func sessionError(err error) bool {
+	for _, s := range []error{
+		ErrSessionBroken,
+		ErrWrongVersion,
+		ErrNotInRightProtocolPhase,
+		ErrBadLogin,
+		ErrCannotLockStoreForWriting,
+		ErrSessionReadOnly,
+		ErrStorageLimitExceeded,
+		ErrDisabledAccount,
+	} {
+		if errors.Is(err, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether err is an error reply outside of the store range, which a
+// server could send for a command it does not implement.
+func unsupported(err error) bool {
+	var pe *ProtocolError
+	return errors.As(err, &pe) && !pe.Store()
+}
+
+// Returns whether a command failed as the server does not know it, so that an
+// older one can be sent instead. bbstored does not reply to unknown commands
+// but drops the connection, which breaks the session: with a dialer the next
+// command reconnects, without one the session stays unusable.
+func (b *BoxBackup) unknownCommand(ctx context.Context, err error) bool {
+	if unsupported(err) {
+		return true
+	}
+	return b.dial != nil && ctx.Err() == nil && b.Broken() != nil
+}
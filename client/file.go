@@ -4,18 +4,50 @@ import (
 	"bbq/client/proto"
 	"bytes"
 	"compress/zlib"
-	"crypto/md5"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/kpango/glg"
 	"rolling/chunker"
 )
 
+var (
+	// Block data can not be decoded or does not match its checksum.
+	ErrCorrupt = errors.New("corrupt block")
+	// Block of the file a diff refers to can not be found.
+	ErrForeign = errors.New("missing block of other file")
+	// File name or attributes can not be decoded.
+	ErrAttributes = errors.New("unreadable attributes")
+	// Object or block is in a format bbq does not know.
+	ErrUnknownEncoding = errors.New("unknown encoding")
+)
+
+// Error of one of the kinds above, keeping the error which caused it. Both can
+// be checked with errors.Is.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
 // RemoteFile structure implements os.FileInfo interface.
 type RemoteFile struct {
 	boxBackup *BoxBackup
@@ -31,18 +63,33 @@ type RemoteFile struct {
 	ModificationTime     time.Time
 	AttributesModTime    time.Time
 	FileGenerationNumber uint32
+	// Keyed hash of the attributes from the directory listing, see
+	// LocalAttributesHash.
+	AttributesHash uint64
 
 	entries []*RemoteFile
 	Symlink string
+	// Device number of character and block devices.
+	Device uint32
+	// Extended attributes by name, such as user.* or security.selinux.
+	Xattrs map[string][]byte
 
 	remote     *Stream
 	fileStream proto.FileStreamFormat
 
 	// Reading state
+	ctx       context.Context // of the open, for requests made while reading
 	idx       *blockIndex
 	curBlock  int64
 	block     []byte
 	blockLeft int
+	foreign   map[int64][]byte // Blocks from the other file of a diff
+
+	// Random access state
+	mu      sync.Mutex
+	offsets []int64 // offset of each block in the file data, and the size
+	offset  int64
+	spool   *os.File // encoded blocks read so far, to read them again
 
 	// Writing state
 	chunkify *chunker.Chunker
@@ -83,20 +130,91 @@ func (f *RemoteFile) Sys() interface{} {
 	return nil
 }
 
+// Returns the attribute hash bbackupd would store for the local file, to be
+// compared with AttributesHash of the stored entry with the same name.
+func (b *BoxBackup) LocalAttributesHash(path string) (uint64, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	rf := &RemoteFile{name: fi.Name()}
+	rf.SetAttributes(fi)
+	if rf.Xattrs, err = readXattrs(path); err != nil {
+		return 0, err
+	}
+	return b.attributesHash(rf), nil
+}
+
+// Sets mode, owner, device number and modification time from a local file.
+// The target of a symlink has to be set separately.
+func (f *RemoteFile) SetAttributes(fi os.FileInfo) {
+	f.mode = fi.Mode()
+	f.UID, f.GID = fileOwner(fi)
+	f.Device = fileDevice(fi)
+	f.ModificationTime = fi.ModTime()
+	f.AttributesModTime = fi.ModTime()
+}
+
 func (b *BoxBackup) OpenFile(curDir, id int64) (*RemoteFile, error) {
-	if _, err := b.Execute(&Operation{Op: proto.GetFile{
+	return b.OpenFileContext(context.Background(), curDir, id)
+}
+
+// Context variant of OpenFile. The context also applies to the requests made
+// later while reading the file, such as for a random access.
+//
+// A file stored as a diff refers to blocks of another file. As the session can
+// not fetch them while the stream of this file is pending, the block index is
+// read first and the referenced blocks are fetched before the file is
+// requested.
+func (b *BoxBackup) OpenFileContext(ctx context.Context, curDir, id int64) (*RemoteFile, error) {
+	idx, err := b.blockIndexByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var foreign map[int64][]byte
+	if need := idx.foreignNeeded(); len(need) > 0 {
+		glg.Debugf("File %x refers to %v blocks in %x", id, len(need), idx.Index.OtherFileID)
+		foreign, err = b.foreignBlocks(ctx, idx.Index.OtherFileID, need, map[int64]bool{id: true})
+		if err != nil {
+			glg.Errorf("Error reading foreign blocks: %v", err)
+			return nil, fmt.Errorf("read foreign blocks: %w", err)
+		}
+	}
+	f, err := b.getFileStream(ctx, curDir, id)
+	if err != nil {
+		return nil, err
+	}
+	f.foreign = foreign
+	return f, nil
+}
+
+// Requests file id and reads its stream up to the block data.
+func (b *BoxBackup) getFileStream(ctx context.Context, curDir, id int64) (*RemoteFile, error) {
+	if _, err := b.ExecuteContext(ctx, &Operation{Op: proto.GetFile{
 		InDirectory: curDir,
 		ObjectID:    id,
 	}}); err != nil {
-		return nil, fmt.Errorf("get file failed: %q", err)
+		return nil, fmt.Errorf("get file failed: %w", err)
 	}
 
 	rd, err := b.GetStream()
 	if err != nil {
-		return nil, fmt.Errorf("unable to read stream: %q", err)
+		return nil, fmt.Errorf("unable to read stream: %w", err)
+	}
+	f, err := b.openFileStream(ctx, rd, curDir, id)
+	if err != nil {
+		// The rest of the stream has to be read before the next command.
+		rd.Close()
+		return nil, err
 	}
+	return f, nil
+}
+
+func (b *BoxBackup) openFileStream(ctx context.Context, rd *Stream, curDir, id int64) (*RemoteFile, error) {
 	f := &RemoteFile{
+		ctx:       ctx,
 		Id:        id,
+		ParentId:  curDir,
 		boxBackup: b,
 		remote:    rd,
 		idx:       b.readBlockIndex(rd),
@@ -104,28 +222,52 @@ func (b *BoxBackup) OpenFile(curDir, id int64) (*RemoteFile, error) {
 
 	if err := binary.Read(rd, binary.BigEndian, &f.fileStream); err != nil {
 		glg.Errorf("Error opening: %v", err)
-		return nil, fmt.Errorf("open: %v", err)
+		return nil, fmt.Errorf("open: %w", err)
 	}
 	glg.Debugf("file stream: %+v", f.fileStream)
+	if err := checkFileMagic(f.fileStream.MagicValue, f.idx.Index.MagicValue); err != nil {
+		return nil, err
+	}
 	f.size = f.fileStream.NumBlocks
 	f.ModificationTime = time.Unix(int64(f.fileStream.ModificationTime/1e6), 0)
 
 	if n, err := b.readFilenameStream(rd); err != nil {
 		glg.Errorf("Error reading filename: %v", err)
-		return nil, fmt.Errorf("read filename: %v", err)
+		return nil, fmt.Errorf("read filename: %w", &kindError{ErrAttributes, err})
 	} else {
 		f.name = n
 	}
 
 	if err := b.readAttributes(rd, f); err != nil {
 		glg.Errorf("Error reading attributes: %v", err)
-		return nil, fmt.Errorf("read attributes: %v", err)
+		return nil, fmt.Errorf("read attributes: %w", &kindError{ErrAttributes, err})
 	}
 
 	return f, nil
 }
 
+// Checks the magic values of a file stream and its block index. The V0 layout
+// of the earliest bbackupd releases is not supported.
+func checkFileMagic(file, index int32) error {
+	if file != proto.FileMagicV1 {
+		return fmt.Errorf("%w: file magic 0x%x", ErrUnknownEncoding, uint32(file))
+	}
+	if index != proto.BlockIndexMagicV1 {
+		return fmt.Errorf("%w: block index magic 0x%x", ErrUnknownEncoding, uint32(index))
+	}
+	return nil
+}
+
 func (f *RemoteFile) Close() error {
+	if f.spool != nil {
+		f.spool.Close()
+		os.Remove(f.spool.Name())
+		f.spool = nil
+	}
+	if f.remote == nil {
+		// Opened for random access and not read yet.
+		return nil
+	}
 	// flush remaining stream
 	b := make([]byte, 4096)
 	for i := int(f.remote.Remaining()); i > 0; {
@@ -140,7 +282,18 @@ func (f *RemoteFile) Close() error {
 }
 
 func (f *RemoteFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.offsets != nil {
+		n, err := f.readAt(p, f.offset)
+		f.offset += int64(n)
+		return n, err
+	}
+
 	var i int
+	defer func() {
+		f.offset += int64(i)
+	}()
 	for i < len(p) {
 
 		if f.blockLeft < len(f.block) {
@@ -157,18 +310,17 @@ func (f *RemoteFile) Read(p []byte) (int, error) {
 
 		s := f.idx.Sizes[f.curBlock]
 		blk := f.idx.Blocks[f.curBlock]
-
-		if s < 0 {
-			// TODO: check for blocks from other files
-			glg.Warnf("Detected reference to a foreign block: %v", s)
-		}
 		glg.Debugf("processing block of size: %v, %+v", s, blk)
 
-		buf := make([]byte, s)
-		io.ReadFull(f.remote, buf)
-
 		var err error
-		f.block, err = f.boxBackup.decodeBlock(buf, &blk)
+		if s <= 0 {
+			// Block is stored in the other file, as 0 - block number.
+			f.block, err = f.foreignBlock(s, &blk)
+		} else {
+			buf := make([]byte, s)
+			io.ReadFull(f.remote, buf)
+			f.block, err = f.boxBackup.decodeBlock(buf, &blk)
+		}
 		if err != nil {
 			return 0, err
 		}
@@ -179,20 +331,25 @@ func (f *RemoteFile) Read(p []byte) (int, error) {
 	return i, nil
 }
 
+// Starts a new file called name in directory curDir, to be uploaded with
+// Commit. Symlinks, FIFOs and device nodes are stored as files without data,
+// with the attributes describing them: set the mode, and Symlink or Device,
+// before committing.
 func (b *BoxBackup) CreateFile(curDir int64, name string) (*RemoteFile, error) {
-	// TODO: handle AttributesHash and DiffFromFileID at some point.
-
 	f := &RemoteFile{
 		boxBackup: b,
 		name:      name,
 		// Id                   int64
 		ParentId: curDir,
 		// size                 int64
-		mode: 1, // File
+		mode: 0o644,
 		// TODO: do other fields as well
 	}
 
 	var cb chunker.Callback = func(c []byte) error {
+		if len(c) == 0 {
+			return nil
+		}
 		f.chunks = append(f.chunks, c)
 		return nil
 	}
@@ -214,16 +371,47 @@ func (f *RemoteFile) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// Prepares the blocks to upload. If a file with the same name exists already,
+// blocks found in its block index are sent as references to it, so that only
+// changed data is uploaded. Returns ID of the file the blocks refer to.
+func (f *RemoteFile) diffBlocks(ctx context.Context) ([]diffBlock, int64) {
+	var blocks []diffBlock
+	for _, ch := range f.chunks {
+		blocks = append(blocks, newDiffBlock(ch))
+	}
+
+	id, old, err := f.boxBackup.blockIndexByName(ctx, f.ParentId, f.name)
+	if err != nil {
+		glg.Warnf("Unable to get block index of %s: %s", f.name, err)
+		return blocks, 0
+	}
+	if id == 0 {
+		return blocks, 0
+	}
+	d := matchBlocks(bytes.Join(f.chunks, nil), old)
+	if d == nil {
+		return blocks, 0
+	}
+	glg.Debugf("Diffing %s against %x: %v blocks", f.name, id, len(d))
+	return d, id
+}
+
 func (f *RemoteFile) Commit() error {
+	return f.CommitContext(context.Background())
+}
+
+// Context variant of Commit.
+func (f *RemoteFile) CommitContext(ctx context.Context) error {
 	if err := f.chunkify.End(); err != nil {
 		return err
 	}
+	blocks, diffFrom := f.diffBlocks(ctx)
 
 	// First prepare the file stream
 	b := new(bytes.Buffer)
 	fs := proto.FileStreamFormat{
-		MagicValue:       0x66696C65,
-		NumBlocks:        int64(len(f.chunks)),
+		MagicValue:       proto.FileMagicV1,
+		NumBlocks:        int64(len(blocks)),
 		ContainerID:      f.ParentId,
 		ModificationTime: f.ModificationTime.UnixNano() / 1000,
 		// TODO: these fields should be set to something
@@ -247,10 +435,9 @@ func (f *RemoteFile) Commit() error {
 	// Block index will come trailing after the file data
 	bi := &blockIndex{
 		Index: proto.FileBlockIndex{
-			MagicValue: 0x62696478,
-			// TODO: do this other file ID also.
-			OtherFileID: 0,
-			NumBlocks:   int64(len(f.chunks)),
+			MagicValue:  proto.BlockIndexMagicV1,
+			OtherFileID: diffFrom,
+			NumBlocks:   int64(len(blocks)),
 		},
 	}
 	rand.Read(bi.Index.EntryIVBase[:])
@@ -260,13 +447,16 @@ func (f *RemoteFile) Commit() error {
 	var bh uint8 // Block header
 
 	// Send the file chunks first, as in Storage format.
-	for _, ch := range f.chunks {
-
-		bi.Blocks = append(bi.Blocks, proto.FileBlockIndexEntry{
-			Size:           int32(len(ch)), // decrypted size
-			WeakChecksum:   calcRollingChecksum(ch),
-			StrongChecksum: md5.Sum(ch),
-		})
+	for _, blk := range blocks {
+		bi.Blocks = append(bi.Blocks, blk.entry)
+
+		ch := blk.data
+		if ch == nil {
+			// Blocks from the other file are encoded as 0 - block number
+			// and have no data in the stream.
+			bi.Sizes = append(bi.Sizes, -blk.ref)
+			continue
+		}
 
 		zb.Reset()
 		z.Reset(zb)
@@ -280,9 +470,9 @@ func (f *RemoteFile) Commit() error {
 		if (100 * zb.Len() / len(ch)) < 95 {
 			glg.Debugf("Compressed to: %v%% (%v, %v)", 100*zb.Len()/len(ch), zb.Len(), len(ch))
 			ch = zb.Bytes()
-			bh = 0b11
+			bh = proto.BlockEncodingAES<<1 | 1
 		} else {
-			bh = 0b10
+			bh = proto.BlockEncodingAES << 1
 		}
 
 		iv := make([]byte, 16)
@@ -301,20 +491,19 @@ func (f *RemoteFile) Commit() error {
 
 	f.boxBackup.writeBlockIndex(b, bi)
 
-	_, err = f.boxBackup.Execute(&Operation{
+	_, err = f.boxBackup.ExecuteContext(ctx, &Operation{
 		Op: proto.StoreFile{
 			DirectoryObjectID: f.ParentId,
 			ModificationTime:  fs.ModificationTime,
-			// TODO: handle attribute hashes
-			AttributesHash: 0,
-			// TODO: handle diff files
-			DiffFromFileID: 0, // 0 if the file is not a diff
+			AttributesHash:    int64(f.boxBackup.attributesHash(f)),
+			DiffFromFileID:    diffFrom, // 0 if the file is not a diff
 		},
 		Tail:   ef,
 		Stream: b,
 	})
 	if err != nil {
-		return fmt.Errorf("get file failed: %q", err)
+		return fmt.Errorf("get file failed: %w", err)
 	}
+	f.boxBackup.cache.forget(f.ParentId)
 	return nil
 }
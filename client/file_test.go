@@ -3,20 +3,20 @@ package client
 import (
 	"bbq/client/proto"
 	"bbq/crypto"
+	"crypto/md5"
+	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/kpango/glg"
 )
 
 func TestStoreFile(t *testing.T) {
-	cr, err := crypto.NewCrypto("../1-FileEncKeys.raw")
-	if err != nil {
-		t.Errorf("Unable to load crypto")
-		return
-	}
+	cr := newTestCrypto(t)
 
 	s, c := net.Pipe()
 	bbs := NewBoxBackup(s, cr)
@@ -47,11 +47,7 @@ func TestStoreFile(t *testing.T) {
 func TestWriteFile(t *testing.T) {
 	glg.Get().DisableColor()
 
-	cr, err := crypto.NewCrypto("../1-FileEncKeys.raw")
-	if err != nil {
-		t.Errorf("Unable to load crypto")
-		return
-	}
+	cr := newTestCrypto(t)
 
 	s, c := net.Pipe()
 	bbs := NewBoxBackup(s, cr)
@@ -88,6 +84,10 @@ func TestWriteFile(t *testing.T) {
 		done <- true
 	}()
 
+	// No previous version of the file to diff against.
+	recvCommand(t, c, false)
+	sendCommand(c, &Operation{Op: proto.Success{}})
+
 	h := make([]byte, 50)
 	io.ReadFull(c, h)
 	glg.Infof("Header: % X", h)
@@ -96,3 +96,128 @@ func TestWriteFile(t *testing.T) {
 	sendCommand(c, &Operation{Op: proto.Success{}})
 	<-done
 }
+
+func TestAttributesHash(t *testing.T) {
+	bb, ts := newTestStore(t)
+	p := filepath.Join(t.TempDir(), "f")
+	if err := ioutil.WriteFile(p, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := bb.LocalAttributesHash(p)
+	if err != nil {
+		t.Fatalf("LocalAttributesHash: %s", err)
+	}
+
+	// Hash carried in the directory listing.
+	fi, _ := os.Lstat(p)
+	e := ts.addFile(1, 2, "f", []byte("x"))
+	e.SetAttributes(fi)
+	e.AttributesHash = bb.attributesHash(e)
+	de, err := bb.ReadDir(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if de[0].AttributesHash != h {
+		t.Errorf("Listed hash %x, want %x", de[0].AttributesHash, h)
+	}
+
+	// Other keys, mode or name give a different hash.
+	other, _ := newTestSession(t)
+	if other.attributesHash(e) == h {
+		t.Errorf("Hash does not depend on the keys")
+	}
+	os.Chmod(p, 0o600)
+	if h2, _ := bb.LocalAttributesHash(p); h2 == h {
+		t.Errorf("Hash does not depend on the mode")
+	}
+	e.name = "g"
+	if bb.attributesHash(e) == h {
+		t.Errorf("Hash does not depend on the name")
+	}
+}
+
+// The hash sent with an upload is the one the store lists and the one of the
+// local file.
+func TestAttributesHashStored(t *testing.T) {
+	bb, ts := newTestStore(t)
+	dir := t.TempDir()
+	p := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(p, []byte("some data"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := bb.Backup(dir, 1, nil); err != nil {
+		t.Fatalf("Backup: %s", err)
+	}
+	h, err := bb.LocalAttributesHash(p)
+	if err != nil {
+		t.Fatalf("LocalAttributesHash: %s", err)
+	}
+	de, err := bb.ReadDir(1)
+	if err != nil || len(de) != 1 {
+		t.Fatalf("ReadDir: %v entries, %v", len(de), err)
+	}
+	if de[0].AttributesHash != h || ts.current(1, "f").AttributesHash != h {
+		t.Errorf("Listed hash %x, want %x", de[0].AttributesHash, h)
+	}
+}
+
+// Hashes of the byte layout of BackupClientFileAttributes::GenerateAttributeHash
+// in bbackupd: big endian UID, GID and st_mode, the xattr block if there is
+// one, the name and the attribute secret at offset 256 of the keys file. The
+// values were computed with Python's hashlib over the bytes below, for a keys
+// file holding the bytes 0, 1, 2 and so on, taking the first 8 bytes of the
+// digest as little endian.
+func TestAttributesHashKnown(t *testing.T) {
+	k := make([]byte, 1024)
+	for i := range k {
+		k[i] = byte(i)
+	}
+	fn := filepath.Join(t.TempDir(), "keys.raw")
+	if err := ioutil.WriteFile(fn, k, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cr, err := crypto.NewCrypto(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb := NewBoxBackup(nil, cr)
+
+	owner := []byte{
+		0x00, 0x00, 0x03, 0xe8, // UID 1000
+		0x00, 0x00, 0x03, 0xe8, // GID 1000
+		0x00, 0x00, 0x81, 0xa4, // S_IFREG | 0644
+	}
+	xattrs := append([]byte{
+		0x00, 0x00, 0x00, 0x18, // size of the entries
+		0x00, 0x0d, // name length with the terminating 0
+	}, "user.comment\x00\x00\x00\x00\x05hello"...)
+	for _, tc := range []struct {
+		layout []byte
+		hash   uint64
+	}{
+		{concat(owner, []byte("notes.txt")), 0xbb8cc06747cbdbc4},
+		{concat(owner, xattrs, []byte("notes.txt")), 0xdbbd45984b86db8f},
+	} {
+		d := md5.Sum(concat(tc.layout, k[256:384]))
+		if h := binary.LittleEndian.Uint64(d[:]); h != tc.hash {
+			t.Fatalf("Layout %x hashes to %x, want %x", tc.layout, h, tc.hash)
+		}
+	}
+
+	f := &RemoteFile{name: "notes.txt", UID: 1000, GID: 1000, mode: 0o644}
+	if h := bb.attributesHash(f); h != 0xbb8cc06747cbdbc4 {
+		t.Errorf("Hash without xattrs: %x", h)
+	}
+	f.Xattrs = map[string][]byte{"user.comment": []byte("hello")}
+	if h := bb.attributesHash(f); h != 0xdbbd45984b86db8f {
+		t.Errorf("Hash with xattrs: %x", h)
+	}
+}
+
+func concat(b ...[]byte) []byte {
+	var r []byte
+	for _, p := range b {
+		r = append(r, p...)
+	}
+	return r
+}
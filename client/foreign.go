@@ -0,0 +1,153 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/kpango/glg"
+)
+
+// Fetches object id in store format and decodes the blocks in want, which
+// idx is the block index of. The other blocks are skipped as they arrive, as
+// the protocol has no command for fetching single blocks.
+func (b *BoxBackup) readObjectBlocks(ctx context.Context, id int64, idx *blockIndex, want map[int64]bool) (map[int64][]byte, error) {
+	if _, err := b.ExecuteContext(ctx, &Operation{Op: proto.GetObject{
+		ObjectID: id,
+	}}); err != nil {
+		return nil, fmt.Errorf("get object failed: %w", err)
+	}
+	rd, err := b.GetStream()
+	if err != nil {
+		return nil, err
+	}
+	// The rest of the stream has to be read before the next command.
+	defer rd.Close()
+
+	var fs proto.FileStreamFormat
+	if err := binary.Read(rd, binary.BigEndian, &fs); err != nil {
+		return nil, err
+	}
+	if fs.MagicValue != proto.FileMagicV1 {
+		return nil, fmt.Errorf("object %x is not a file: %w: magic 0x%x", id, ErrUnknownEncoding, uint32(fs.MagicValue))
+	}
+	if _, err := b.readFilenameStream(rd); err != nil {
+		return nil, err
+	}
+	if err := b.readAttributes(rd, &RemoteFile{}); err != nil {
+		return nil, err
+	}
+
+	r := make(map[int64][]byte)
+	for n, s := range idx.Sizes {
+		if len(r) == len(want) {
+			break
+		}
+		if s <= 0 {
+			continue
+		}
+		if !want[int64(n)] {
+			if _, err := io.CopyN(ioutil.Discard, rd, s); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		buf := make([]byte, s)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		d, err := b.decodeBlock(buf, &idx.Blocks[n])
+		if err != nil {
+			return nil, fmt.Errorf("block %v of %x: %w", n, id, err)
+		}
+		r[int64(n)] = d
+	}
+	return r, nil
+}
+
+// Decodes blocks of file id with the given numbers, following the references
+// of diffs into older or newer files until the data is found. Only the needed
+// blocks are kept.
+func (b *BoxBackup) foreignBlocks(ctx context.Context, id int64, need []int64, seen map[int64]bool) (map[int64][]byte, error) {
+	if seen[id] {
+		return nil, fmt.Errorf("%w: loop in diff chain at %x", ErrForeign, id)
+	}
+	seen[id] = true
+
+	idx, err := b.blockIndexByID(ctx, id)
+	if errors.Is(err, ErrDoesNotExist) {
+		return nil, &kindError{ErrForeign, err}
+	} else if err != nil {
+		return nil, err
+	}
+
+	want := make(map[int64]bool)
+	refs := make(map[int64][]int64) // block in the other file -> blocks here
+	var further []int64
+	for _, n := range need {
+		if n < 0 || n >= int64(len(idx.Sizes)) {
+			return nil, fmt.Errorf("%w: block %v does not exist in %x", ErrForeign, n, id)
+		}
+		s := idx.Sizes[n]
+		if s > 0 {
+			want[n] = true
+			continue
+		}
+		if _, ok := refs[-s]; !ok {
+			further = append(further, -s)
+		}
+		refs[-s] = append(refs[-s], n)
+	}
+
+	r := make(map[int64][]byte)
+	if len(want) > 0 {
+		if r, err = b.readObjectBlocks(ctx, id, idx, want); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(further) > 0 {
+		glg.Debugf("Following %v blocks from %x to %x", len(further), id, idx.Index.OtherFileID)
+		fb, err := b.foreignBlocks(ctx, idx.Index.OtherFileID, further, seen)
+		if err != nil {
+			return nil, err
+		}
+		for m, d := range fb {
+			for _, n := range refs[m] {
+				r[n] = d
+			}
+		}
+	}
+	return r, nil
+}
+
+// Returns the numbers of the blocks the file refers to in the other file.
+func (idx *blockIndex) foreignNeeded() []int64 {
+	var need []int64
+	seen := make(map[int64]bool)
+	for _, s := range idx.Sizes {
+		if s <= 0 && !seen[-s] {
+			need = append(need, -s)
+			seen[-s] = true
+		}
+	}
+	return need
+}
+
+// Returns a block from the other file, checking it against the entry in this
+// file's index.
+func (f *RemoteFile) foreignBlock(s int64, blk *proto.FileBlockIndexEntry) ([]byte, error) {
+	d, ok := f.foreign[-s]
+	if !ok {
+		return nil, fmt.Errorf("%w: block %v of %x", ErrForeign, -s, f.idx.Index.OtherFileID)
+	}
+	if int32(len(d)) != blk.Size || md5.Sum(d) != blk.StrongChecksum {
+		return nil, fmt.Errorf("%w: block %v of %x does not match", ErrForeign, -s, f.idx.Index.OtherFileID)
+	}
+	return d, nil
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// Encodes data as a file in store format, split into blocks of size bs. Blocks
+// listed in refs are stored as references to a block of file other.
+func testStoreObject(bb *BoxBackup, data []byte, bs int, other int64, refs map[int]int64) []byte {
+	n := (len(data) + bs - 1) / bs
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, &proto.FileStreamFormat{
+		MagicValue: 0x66696C65,
+		NumBlocks:  int64(n),
+	})
+	ef, _ := bb.writeFilename("test")
+	buf.Write(ef)
+	bb.writeAttributes(buf, &RemoteFile{})
+
+	bi := &blockIndex{
+		Index: proto.FileBlockIndex{
+			MagicValue:  0x62696478,
+			OtherFileID: other,
+			NumBlocks:   int64(n),
+		},
+	}
+	for i := 0; i < n; i++ {
+		e := (i + 1) * bs
+		if e > len(data) {
+			e = len(data)
+		}
+		blk := newDiffBlock(data[i*bs : e])
+		bi.Blocks = append(bi.Blocks, blk.entry)
+		if r, ok := refs[i]; ok {
+			bi.Sizes = append(bi.Sizes, -r)
+			continue
+		}
+		iv := make([]byte, 16)
+		ct, _ := bb.crypt.EncryptFileData(blk.data, iv)
+		buf.WriteByte(proto.BlockEncodingAES << 1)
+		buf.Write(ct)
+		bi.Sizes = append(bi.Sizes, int64(len(ct)+1))
+	}
+	bb.writeBlockIndex(buf, bi)
+	return buf.Bytes()
+}
+
+// Size of the block index at the end of an object from testStoreObject.
+func testIndexSize(o []byte) int {
+	var fs proto.FileStreamFormat
+	binary.Read(bytes.NewReader(o), binary.BigEndian, &fs)
+	return binary.Size(proto.FileBlockIndex{}) +
+		int(fs.NumBlocks)*(8+binary.Size(proto.FileBlockIndexEntry{}))
+}
+
+// Serves the objects by ID until the connection closes: in store format for
+// GetObject, with the block index first for GetFile, and their block indexes
+// for GetBlockIndexByID. The GetFile requests are counted in files if set.
+func serveObjects(t *testing.T, s net.Conn, objects map[int64][]byte, files map[int64]int) {
+	reply := func(id int64, stream []byte) {
+		sendCommand(s, &Operation{Op: proto.Success{ObjectID: id}})
+		binary.Write(s, binary.BigEndian, &proto.Header{
+			Size:    uint32(len(stream)),
+			Command: proto.STREAM_TYPE,
+		})
+		s.Write(stream)
+	}
+	for {
+		var hdr proto.Header
+		if err := binary.Read(s, binary.BigEndian, &hdr); err != nil {
+			return
+		}
+		cmd, _ := proto.GetCommand(hdr.Command)
+		buf := make([]byte, hdr.Size-uint32(binary.Size(hdr)))
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return
+		}
+		binary.Read(bytes.NewReader(buf), binary.BigEndian, cmd)
+
+		var id int64
+		switch op := cmd.(type) {
+		case *proto.GetObject:
+			id = op.ObjectID
+		case *proto.GetFile:
+			id = op.ObjectID
+			if files != nil {
+				files[id]++
+			}
+		case *proto.GetBlockIndexByID:
+			id = op.ObjectID
+		default:
+			t.Errorf("Unexpected command: %T", cmd)
+			return
+		}
+		o, ok := objects[id]
+		if !ok {
+			sendCommand(s, &Operation{Op: proto.Error{Type: storeErrorType, SubType: 7}})
+			continue
+		}
+		i := len(o) - testIndexSize(o)
+		switch cmd.(type) {
+		case *proto.GetObject:
+			reply(id, o)
+		case *proto.GetFile:
+			reply(id, append(append([]byte{}, o[i:]...), o[:i]...))
+		case *proto.GetBlockIndexByID:
+			reply(id, o[i:])
+		}
+	}
+}
+
+func TestForeignBlocks(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	data := make([]byte, 3*1024)
+	rand.Read(data)
+	blk := func(i int) []byte {
+		return data[i*1024 : (i+1)*1024]
+	}
+
+	// File 8 refers to 7, which in turn refers to 6 for its second block.
+	objects := map[int64][]byte{
+		8: testStoreObject(bb, data, 1024, 7, map[int]int64{0: 0, 2: 1}),
+		7: testStoreObject(bb, append(append([]byte{}, blk(0)...), blk(2)...), 1024, 6,
+			map[int]int64{1: 0}),
+		6: testStoreObject(bb, blk(2), 1024, 0, nil),
+	}
+
+	go serveObjects(t, s, objects, nil)
+
+	r, err := bb.foreignBlocks(context.Background(), 8, []int64{0, 1, 2}, map[int64]bool{})
+	if err != nil {
+		t.Fatalf("foreignBlocks: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if !bytes.Equal(r[int64(i)], blk(i)) {
+			t.Errorf("Block %v does not match", i)
+		}
+	}
+}
+
+func TestForeignBlocksErrors(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	data := make([]byte, 2*1024)
+	rand.Read(data)
+	corrupt := testStoreObject(bb, data, 1024, 0, nil)
+	// Flip a byte at the end of the last block, before the block index.
+	corrupt[len(corrupt)-testIndexSize(corrupt)-5] ^= 0xff
+	objects := map[int64][]byte{
+		7: testStoreObject(bb, data, 1024, 0, nil),
+		6: corrupt,
+	}
+	go serveObjects(t, s, objects, nil)
+
+	ctx := context.Background()
+	if _, err := bb.foreignBlocks(ctx, 7, []int64{5}, map[int64]bool{}); !errors.Is(err, ErrForeign) {
+		t.Errorf("Missing block: got %v, want ErrForeign", err)
+	}
+	_, err := bb.foreignBlocks(ctx, 5, []int64{0}, map[int64]bool{})
+	if !errors.Is(err, ErrForeign) || !errors.Is(err, ErrDoesNotExist) {
+		t.Errorf("Missing object: got %v, want ErrForeign and ErrDoesNotExist", err)
+	}
+	_, err = bb.foreignBlocks(ctx, 6, []int64{1}, map[int64]bool{})
+	if !errors.Is(err, ErrCorrupt) || errors.Is(err, ErrForeign) {
+		t.Errorf("Corrupt block: got %v, want ErrCorrupt only", err)
+	}
+}
+
+func TestOpenFileDiff(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	data := make([]byte, 4*1024)
+	rand.Read(data)
+	// File 8 refers to 7 for its first and last block.
+	old := append(append([]byte{}, data[3*1024:]...), data[:1024]...)
+	objects := map[int64][]byte{
+		8: testStoreObject(bb, data, 1024, 7, map[int]int64{0: 1, 3: 0}),
+		7: testStoreObject(bb, old, 1024, 0, nil),
+	}
+	files := make(map[int64]int)
+	go serveObjects(t, s, objects, files)
+
+	f, err := bb.OpenFile(1, 8)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	if files[8] != 1 {
+		t.Errorf("Requested the file %v times, want once", files[8])
+	}
+	if len(f.foreign) != 2 {
+		t.Errorf("Kept %v blocks of the other file, want 2", len(f.foreign))
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Data does not match")
+	}
+	f.Close()
+
+	// Random access fetches the other file before the stream.
+	f, err = bb.OpenFileRandom(1, 8)
+	if err != nil {
+		t.Fatalf("OpenFileRandom: %s", err)
+	}
+	defer f.Close()
+	p := make([]byte, 1024)
+	if _, err := f.ReadAt(p, 3*1024); err != nil || !bytes.Equal(p, data[3*1024:]) {
+		t.Errorf("ReadAt last block: %v", err)
+	}
+	if _, err := f.ReadAt(p, 0); err != nil || !bytes.Equal(p, data[:1024]) {
+		t.Errorf("ReadAt first block: %v", err)
+	}
+}
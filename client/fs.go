@@ -0,0 +1,332 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FSOptions select which entries are visible through FS and how files are
+// read.
+type FSOptions struct {
+	// Show deleted entries when there is no current one with the same name.
+	IncludeDeleted bool
+	// Show old versions of files as name.0x<id>.
+	IncludeOld bool
+	// Show the store as it looked at this time, see AsOf.
+	AsOf time.Time
+	// Sessions for reading files, each open file using one until it is
+	// closed. Without a pool, files are read into memory when opened.
+	Pool *Pool
+}
+
+// FS implements fs.FS over the store, with paths starting from the root
+// directory. Sizes of files are in bytes, as http.FS and others expect. As
+// directory listings only carry sizes in store blocks, Stat and the Info of
+// directory entries fetch the block index of the file.
+//
+// Listings are cached by the session, see ClearCache. Open files do not hold
+// the session, so any number of them can be open while the FS is used.
+type FS struct {
+	b    *BoxBackup
+	opts FSOptions
+}
+
+var _ fs.ReadDirFS = (*FS)(nil)
+var _ fs.ReadFileFS = (*FS)(nil)
+var _ fs.StatFS = (*FS)(nil)
+
+func NewFS(b *BoxBackup, opts *FSOptions) *FS {
+	f := &FS{
+		b: b,
+	}
+	if opts != nil {
+		f.opts = *opts
+	}
+	return f
+}
+
+// Directory entry with the name it is visible under. Implements both
+// fs.FileInfo and fs.DirEntry.
+type fsEntry struct {
+	*RemoteFile
+	name string
+	fs   *FS // listing the entry, for fetching its size
+	// Size of the file data in bytes, once known.
+	size  int64
+	sized bool
+}
+
+func (e *fsEntry) Name() string {
+	return e.name
+}
+
+func (e *fsEntry) Size() int64 {
+	if e.sized {
+		return e.size
+	}
+	return e.RemoteFile.Size()
+}
+
+// Returns the entry with the size of a file in bytes, from its block index.
+func (f *FS) sized(e *fsEntry) (*fsEntry, error) {
+	if e.sized || e.IsDir() {
+		return e, nil
+	}
+	idx, err := f.b.blockIndexByID(context.Background(), e.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &fsEntry{RemoteFile: e.RemoteFile, name: e.name, size: idx.dataSize(), sized: true}, nil
+}
+
+func (e *fsEntry) Type() fs.FileMode {
+	return e.Mode().Type()
+}
+
+func (e *fsEntry) Info() (fs.FileInfo, error) {
+	if e.fs == nil {
+		return e, nil
+	}
+	i, err := e.fs.sized(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: e.name, Err: err}
+	}
+	return i, nil
+}
+
+func (f *FS) readDir(id int64) ([]*fsEntry, error) {
+	de, err := f.b.ReadDirCached(id)
+	if err != nil {
+		return nil, err
+	}
+	var r []*fsEntry
+	for _, e := range selectEntries(de, f.opts.IncludeDeleted, f.opts.IncludeOld, f.opts.AsOf) {
+		r = append(r, &fsEntry{RemoteFile: e.f, name: e.name, fs: f})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].name < r[j].name
+	})
+	return r, nil
+}
+
+// Finds the entry for a slash separated path.
+func (f *FS) lookup(op, name string) (*fsEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e := &fsEntry{
+		RemoteFile: rootEntry(),
+		name:       ".",
+	}
+	if name == "." {
+		return e, nil
+	}
+
+	for _, n := range strings.Split(name, "/") {
+		if !e.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		de, err := f.readDir(e.Id)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		i := sort.Search(len(de), func(i int) bool {
+			return de[i].name >= n
+		})
+		if i == len(de) || de[i].name != n {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		e = de[i]
+	}
+	return e, nil
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	e, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.IsDir() {
+		return &fsDir{fs: f, entry: e, path: name}, nil
+	}
+	if f.opts.Pool == nil {
+		return f.openBuffered(name, e)
+	}
+	b, err := f.opts.Pool.Get()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	rf, err := b.OpenFile(e.ParentId, e.Id)
+	if err != nil {
+		f.opts.Pool.Discard(b)
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	se := &fsEntry{RemoteFile: e.RemoteFile, name: e.name, size: rf.idx.dataSize(), sized: true}
+	return &fsFile{
+		file:  rf,
+		entry: se,
+		close: func() error {
+			if err := rf.Close(); err != nil {
+				f.opts.Pool.Discard(b)
+				return err
+			}
+			f.opts.Pool.Put(b)
+			return nil
+		},
+	}, nil
+}
+
+// Reads the whole file, so that the session is free again.
+func (f *FS) openBuffered(name string, e *fsEntry) (fs.File, error) {
+	rf, err := f.b.OpenFile(e.ParentId, e.Id)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	d, err := ioutil.ReadAll(rf)
+	if cerr := rf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	se := &fsEntry{RemoteFile: e.RemoteFile, name: e.name, size: int64(len(d)), sized: true}
+	return &fsFile{
+		file:  bytes.NewReader(d),
+		entry: se,
+		close: func() error { return nil },
+	}, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	e, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	i, err := f.sized(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return i, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	de, err := f.readDir(e.Id)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	r := make([]fs.DirEntry, len(de))
+	for i, d := range de {
+		r[i] = d
+	}
+	return r, nil
+}
+
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	fl, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fl.Close()
+	if _, ok := fl.(*fsDir); ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return ioutil.ReadAll(fl)
+}
+
+// File opened through FS, read from a session of the pool or from memory.
+type fsFile struct {
+	file interface {
+		io.Reader
+		io.ReaderAt
+		io.Seeker
+	}
+	entry *fsEntry
+	close func() error
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.entry, nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	return f.file.Read(p)
+}
+
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.file.ReadAt(p, off)
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+func (f *fsFile) Close() error {
+	if f.close == nil {
+		return fs.ErrClosed
+	}
+	c := f.close
+	f.close = nil
+	return c()
+}
+
+// Directory opened through FS.
+type fsDir struct {
+	fs      *FS
+	entry   *fsEntry
+	path    string
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.entry, nil
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		de, err := d.fs.readDir(d.entry.Id)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.path, Err: err}
+		}
+		for _, e := range de {
+			d.entries = append(d.entries, e)
+		}
+		d.read = true
+	}
+	if n <= 0 {
+		r := d.entries
+		d.entries = nil
+		return r, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	r := d.entries[:n]
+	d.entries = d.entries[n:]
+	return r, nil
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	bb, ts := newTestStore(t)
+	ts.addFile(1, 2, "a", []byte("hello"))
+	ts.addDir(1, 3, "d")
+	ts.addFile(3, 4, "b", bytes.Repeat([]byte("0123456789"), 300))
+	ts.addFile(3, 5, "b", []byte("old")).Flags |= proto.Flags_OldVersion
+	ts.addFile(1, 6, "gone", []byte("deleted")).Flags |= proto.Flags_Deleted
+
+	if err := fstest.TestFS(NewFS(bb, nil), "a", "d/b"); err != nil {
+		t.Errorf("TestFS: %s", err)
+	}
+
+	all := NewFS(bb, &FSOptions{IncludeDeleted: true, IncludeOld: true})
+	if err := fstest.TestFS(all, "a", "d/b", "d/b.0x5", "gone"); err != nil {
+		t.Errorf("TestFS with old and deleted: %s", err)
+	}
+	if d, err := fs.ReadFile(all, "d/b.0x5"); err != nil || string(d) != "old" {
+		t.Errorf("Reading old version: %q, %v", d, err)
+	}
+}
+
+func TestFSHTTP(t *testing.T) {
+	bb, ts := newTestStore(t)
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	ts.addFile(1, 2, "a", data)
+
+	srv := httptest.NewServer(http.FileServer(http.FS(NewFS(bb, nil))))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/a")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Reading body: %s", err)
+	}
+	if resp.ContentLength != int64(len(data)) || !bytes.Equal(body, data) {
+		t.Errorf("Served %v bytes with length %v, want %v", len(body), resp.ContentLength, len(data))
+	}
+}
+
+func TestFSOpenFiles(t *testing.T) {
+	bb, ts := newTestStore(t)
+	ts.addFile(1, 2, "a", []byte("hello"))
+	ts.addDir(1, 3, "d")
+	ts.addFile(3, 4, "b", bytes.Repeat([]byte("0123456789"), 300))
+
+	pool := NewPool(2, func() (*BoxBackup, error) {
+		return ts.session(), nil
+	})
+	defer pool.Close()
+	for _, opts := range []*FSOptions{nil, {Pool: pool}} {
+		fsys := NewFS(bb, opts)
+		if err := fstest.TestFS(fsys, "a", "d/b"); err != nil {
+			t.Errorf("TestFS with %+v: %s", opts, err)
+		}
+
+		// Files stay open while the FS is used for others.
+		a, err := fsys.Open("a")
+		if err != nil {
+			t.Fatalf("Open: %s", err)
+		}
+		b, err := fsys.Open("d/b")
+		if err != nil {
+			t.Fatalf("Open while another file is open: %s", err)
+		}
+		if _, err := fs.Stat(fsys, "d/b"); err != nil {
+			t.Errorf("Stat while files are open: %s", err)
+		}
+		if de, err := fs.ReadDir(fsys, "d"); err != nil || len(de) != 1 {
+			t.Errorf("ReadDir while files are open: %v entries, %v", len(de), err)
+		}
+		if d, err := ioutil.ReadAll(a); err != nil || string(d) != "hello" {
+			t.Errorf("Reading a: %q, %v", d, err)
+		}
+		if d, err := ioutil.ReadAll(b); err != nil || len(d) != 3000 {
+			t.Errorf("Reading d/b: %v bytes, %v", len(d), err)
+		}
+		a.Close()
+		b.Close()
+	}
+
+	// Paths are looked up in the cached listings.
+	lists := ts.lists
+	if _, err := fs.Stat(NewFS(bb, nil), "d/b"); err != nil {
+		t.Errorf("Stat: %s", err)
+	}
+	if ts.lists != lists {
+		t.Errorf("Listed %v directories again for a path", ts.lists-lists)
+	}
+}
@@ -4,23 +4,36 @@ import (
 	"bbq/client/proto"
 	"bufio"
 	"bytes"
+	"crypto/aes"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/kpango/glg"
 )
 
+// Stream following a command reply. Reads stop at its end.
 type Stream struct {
 	size   uint32
 	reader *bufio.Reader
+	// Frees the session once the stream is read, nil for buffered streams.
+	release func()
+	// Marks the session broken when the stream can not be read to its end.
+	fail func(error) error
+	err  error
 }
 
 func (s *Stream) Peek(i int) ([]byte, error) {
+	if uint32(i) > s.size {
+		return nil, io.ErrUnexpectedEOF
+	}
 	return s.reader.Peek(i)
 }
 
@@ -29,19 +42,66 @@ func (s *Stream) Remaining() uint32 {
 }
 
 func (s *Stream) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.size == 0 {
+		s.done()
+		return 0, io.EOF
+	}
+	if uint32(len(p)) > s.size {
+		p = p[:s.size]
+	}
 	n, err := s.reader.Read(p)
-	if err == nil && s.size >= uint32(n) {
-		s.size -= uint32(n)
+	s.size -= uint32(n)
+	if err != nil {
+		if s.fail != nil {
+			err = s.fail(err)
+		}
+		s.err = err
+		s.done()
+	} else if s.size == 0 {
+		s.done()
 	}
 	return n, err
 }
 
+func (s *Stream) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(s, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Reads the rest of the stream, freeing the session.
+func (s *Stream) Close() error {
+	defer s.done()
+	_, err := io.CopyN(ioutil.Discard, s, int64(s.size))
+	return err
+}
+
+func (s *Stream) done() {
+	if s.release != nil {
+		s.release()
+	}
+}
+
 type blockIndex struct {
 	Index  proto.FileBlockIndex
 	Sizes  []int64
 	Blocks []proto.FileBlockIndexEntry
 }
 
+// Returns the size of the file data in bytes.
+func (idx *blockIndex) dataSize() int64 {
+	var s int64
+	for _, b := range idx.Blocks {
+		s += int64(b.Size)
+	}
+	return s
+}
+
 var fileModes = []struct {
 	unix   uint8
 	golang os.FileMode
@@ -54,7 +114,7 @@ var fileModes = []struct {
 	// #define __S_IFLNK       0120000 // Symbolic link.
 	// #define __S_IFSOCK      0140000 // Socket.
 	{0o1, os.ModeNamedPipe},
-	{0o2, os.ModeCharDevice},
+	{0o2, os.ModeDevice | os.ModeCharDevice},
 	{0o4, os.ModeDir},
 	{0o6, os.ModeDevice},
 	{0o10, 0},
@@ -99,47 +159,85 @@ func calcRollingChecksum(b []byte) uint32 {
 	return uint32(wcB)<<16 | uint32(wcA)
 }
 
+// Checks the weak checksum of decoded block data, returns the calculated one.
+func weakChecksumMatches(d []byte, blk *proto.FileBlockIndexEntry) (uint32, bool) {
+	w := calcRollingChecksum(d)
+	// For some weird reason my rolling checksum is always off by a couple
+	// of increments for the subsequent blocks. Maybe there's a bug in
+	// BoxBackup checksum calculation somewhere.
+	return w, (blk.WeakChecksum ^ w) <= 8
+}
+
 // Decodes a single block into resulting size s.
 func (b *BoxBackup) decodeBlock(buf []byte, blk *proto.FileBlockIndexEntry) ([]byte, error) {
-	compressed := 1 == (buf[0] & 1)
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("%w: empty block", ErrCorrupt)
+	}
 	encoder := buf[0] >> 1
+	if encoder != proto.BlockEncodingBlowfish {
+		out, err := b.decodeBlockAs(encoder, buf, blk)
+		if err != nil {
+			glg.Errorf("Decoding block: %v", err)
+		}
+		return out, err
+	}
+
+	// Earlier versions of bbq marked AES blocks as Blowfish ones. Decryption
+	// works in place, so keep the block for another try.
+	orig := append([]byte{}, buf...)
+	out, err := b.decodeBlockAs(encoder, buf, blk)
+	if errors.Is(err, ErrCorrupt) {
+		if d, aerr := b.decodeBlockAs(proto.BlockEncodingAES, orig, blk); aerr == nil {
+			glg.Debugf("Block marked as Blowfish decoded as AES: %v", err)
+			return d, nil
+		}
+	}
+	if err != nil {
+		glg.Errorf("Decoding block: %v", err)
+	}
+	return out, err
+}
+
+func (b *BoxBackup) decodeBlockAs(encoder byte, buf []byte, blk *proto.FileBlockIndexEntry) ([]byte, error) {
+	compressed := 1 == (buf[0] & 1)
 	glg.Debugf("chunk compressed: %v, encoded: %v", compressed, encoder)
 
 	var out []byte
-	if encoder != 0 {
-		d, err := b.crypt.DecryptFileData(buf[1:])
-		if err != nil {
-			glg.Errorf("decrypting file: %v", err)
-			return nil, err
-		}
-		out = d
-	} else {
+	var err error
+	switch encoder {
+	case proto.BlockEncodingNone:
 		out = buf[1:]
+	case proto.BlockEncodingBlowfish:
+		out, err = b.crypt.DecryptFileDataBF(buf[1:])
+	case proto.BlockEncodingAES:
+		if len(buf) < 1+aes.BlockSize {
+			err = fmt.Errorf("AES text shorter than the IV")
+		} else {
+			out, err = b.crypt.DecryptFileData(buf[1:])
+		}
+	default:
+		return nil, fmt.Errorf("%w: block encoding %v", ErrUnknownEncoding, encoder)
+	}
+	if err != nil {
+		return nil, &kindError{ErrCorrupt, err}
 	}
 
 	if compressed {
 		d := make([]byte, blk.Size)
 		if err := b.crypt.Decompress(out, d); err != nil {
-			glg.Errorf("decompression error: %v", err)
-			return nil, fmt.Errorf("decompression error: %v", err)
+			return nil, &kindError{ErrCorrupt, fmt.Errorf("decompression error: %w", err)}
 		}
-		glg.Debugf("actual decompressed (size: %v): %s", len(d), d[0:20])
+		glg.Debugf("actual decompressed (size: %v)", len(d))
 		out = d
 	}
 
-	w := calcRollingChecksum(out)
-	// For some weird reason my rolling checksum is always off by a couple
-	// of increments for the subsequent blocks. Maybe there's a bug in
-	// BoxBackup checksum calculation somewhere.
-	if (blk.WeakChecksum ^ w) > 8 {
-		// glg.Logf("First bytes: % v, Last byte: % v", f.block[0:4], f.block[len(f.block)-4:])
-		glg.Errorf("Weak checksum failed: 0x%x != 0x%x", w, blk.WeakChecksum)
-	}
-
 	// Do the strong checksum
 	if md5.Sum(out) != blk.StrongChecksum {
-		glg.Error("MD5 checksum failed")
-		return nil, fmt.Errorf("MD5 checksum failed")
+		return nil, fmt.Errorf("%w: MD5 checksum failed", ErrCorrupt)
+	}
+
+	if w, ok := weakChecksumMatches(out, blk); !ok {
+		glg.Errorf("Weak checksum failed: 0x%x != 0x%x", w, blk.WeakChecksum)
 	}
 
 	return out, nil
@@ -173,7 +271,7 @@ func (b *BoxBackup) readBlockIndex(rd *Stream) *blockIndex {
 		binary.Read(rd, binary.BigEndian, &idx.Sizes[i])
 
 		ent := make([]byte, binary.Size(idx.Blocks[0]))
-		rd.Read(ent)
+		io.ReadFull(rd, ent)
 		b.crypt.DecryptBlockIndexEntry(ent, idx.Index.EntryIVBase[:])
 
 		er := bytes.NewReader(ent)
@@ -222,7 +320,8 @@ func (b *BoxBackup) writeFilename(fn string) ([]byte, error) {
 	return buf, nil
 }
 
-func (b *BoxBackup) writeAttributes(buf *bytes.Buffer, rf *RemoteFile) error {
+// Encodes and encrypts file attributes, as sent in attribute streams.
+func (b *BoxBackup) encodeAttributes(rf *RemoteFile) ([]byte, error) {
 	at := proto.AttributeStream{
 		AttributeType:    1, // ATTRIBUTETYPE_GENERIC_UNIX
 		UID:              rf.UID,
@@ -231,45 +330,132 @@ func (b *BoxBackup) writeAttributes(buf *bytes.Buffer, rf *RemoteFile) error {
 		// TODO: fill out the missing members
 		// AttrModificationTime uint64
 		// UserDefinedFlags     uint32
-		// FileGenerationNumber uint32
 		Mode: writeMode(rf.mode),
 	}
+	if rf.mode&os.ModeDevice != 0 {
+		// Device nodes keep the device number in place of the generation.
+		at.FileGenerationNumber = rf.Device
+	}
 	eab := new(bytes.Buffer)
 	binary.Write(eab, binary.BigEndian, &at)
-	ea := eab.Next(binary.Size(at))
+	if rf.mode&os.ModeSymlink != 0 {
+		eab.WriteString(rf.Symlink)
+		eab.WriteByte(0)
+	}
+	if len(rf.Xattrs) > 0 {
+		eab.Write(encodeXattrs(rf.Xattrs))
+	}
+	ea := eab.Bytes()
 
 	iv := make([]byte, 8)
 	rand.Read(iv)
 	eat, err := b.crypt.EncryptAttributes(ea, iv)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var ae uint8 = 2 // Attribute encoding (Blowfish)
-	var s int32 = int32(binary.Size(ae) + len(eat))
-	binary.Write(buf, binary.BigEndian, &s)
-	binary.Write(buf, binary.BigEndian, &ae)
-	binary.Write(buf, binary.BigEndian, eat)
+	// Attribute encoding (Blowfish) goes first.
+	return append([]byte{2}, eat...), nil
+}
+
+// Keyed hash of the attributes, which bbackupd uses to notice changes without
+// decoding them: owner, unix mode, extended attributes and name. Unlike the
+// attributes themselves it does not cover the modification time, which is
+// kept next to it.
+func (b *BoxBackup) attributesHash(rf *RemoteFile) uint64 {
+	hd := new(bytes.Buffer)
+	binary.Write(hd, binary.BigEndian, &struct {
+		UID, GID, Mode uint32
+	}{rf.UID, rf.GID, uint32(writeMode(rf.mode))})
+	// The extended attributes as encoded in the attributes, like bbackupd.
+	if len(rf.Xattrs) > 0 {
+		hd.Write(encodeXattrs(rf.Xattrs))
+	}
+	return b.crypt.HashAttributes(hd.Bytes(), []byte(rf.name))
+}
+
+func xattrNames(x map[string][]byte) []string {
+	var names []string
+	for n := range x {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
 
+// Encodes the extended attribute block which follows the attributes, with the
+// names sorted and 0 terminated.
+func encodeXattrs(x map[string][]byte) []byte {
+	xb := new(bytes.Buffer)
+	for _, n := range xattrNames(x) {
+		binary.Write(xb, binary.BigEndian, uint16(len(n)+1))
+		xb.WriteString(n)
+		xb.WriteByte(0)
+		binary.Write(xb, binary.BigEndian, uint32(len(x[n])))
+		xb.Write(x[n])
+	}
+	buf := make([]byte, 4, 4+xb.Len())
+	binary.BigEndian.PutUint32(buf, uint32(xb.Len()))
+	return append(buf, xb.Bytes()...)
+}
+
+// Decodes the extended attribute block, see encodeXattrs.
+func decodeXattrs(b []byte) (map[string][]byte, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("short xattr block: %v bytes", len(b))
+	}
+	s := binary.BigEndian.Uint32(b)
+	if int64(s) > int64(len(b)-4) {
+		return nil, fmt.Errorf("xattr block size %v exceeds %v bytes", s, len(b)-4)
+	}
+	b = b[4 : 4+s]
+	x := make(map[string][]byte)
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("truncated xattr name")
+		}
+		nl := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+nl+4 {
+			return nil, fmt.Errorf("truncated xattr name")
+		}
+		n := string(bytes.TrimRight(b[2:2+nl], "\x00"))
+		b = b[2+nl:]
+		vl := int64(binary.BigEndian.Uint32(b))
+		if vl > int64(len(b)-4) {
+			return nil, fmt.Errorf("truncated value of xattr %s", n)
+		}
+		x[n] = append([]byte{}, b[4:4+vl]...)
+		b = b[4+vl:]
+	}
+	return x, nil
+}
+
+func (b *BoxBackup) writeAttributes(buf *bytes.Buffer, rf *RemoteFile) error {
+	ea, err := b.encodeAttributes(rf)
+	if err != nil {
+		return err
+	}
+	var s int32 = int32(len(ea))
+	binary.Write(buf, binary.BigEndian, &s)
+	buf.Write(ea)
 	return nil
 }
 
 func (b *BoxBackup) readAttributes(rd *Stream, rf *RemoteFile) error {
 	var skip []byte
 	for {
-		p, err := rd.reader.Peek(4)
+		p, err := rd.Peek(4)
 		if err != nil {
 			return err
 		}
 		if binary.BigEndian.Uint32(p) < rd.size {
 			break
 		}
-		if sb, err := rd.reader.ReadByte(); err != nil {
+		if sb, err := rd.ReadByte(); err != nil {
 			return err
 		} else {
 			skip = append(skip, sb)
 		}
-		p, err = rd.reader.Peek(4)
 	}
 	if len(skip) > 0 {
 		glg.Warnf("Skipping bytes before attributes: % X\nFile: %+v", skip, rf)
@@ -305,28 +491,42 @@ func (b *BoxBackup) readAttributes(rd *Stream, rf *RemoteFile) error {
 		rf.ModificationTime = time.Unix(int64(at.ModificationTime/1e6), 0)
 		rf.AttributesModTime = time.Unix(int64(at.AttrModificationTime/1e6), 0)
 		rf.FileGenerationNumber = at.FileGenerationNumber
+		if rf.mode&os.ModeDevice != 0 {
+			rf.Device = at.FileGenerationNumber
+		}
 
-		if ar.Len() > 0 {
-			if rf.mode&os.ModeSymlink > 0 {
-				// Read symlink name after the attributes
-				rf.Symlink = string(ab[len(ab)-ar.Len():])
-				glg.Debugf("Read symlink: %s", rf.Symlink)
-			} else {
-				// TODO: check for following xattrs
-				glg.Warnf("leftover attributes: %v [% X]", ar.Len(), ab[len(ab)-ar.Len():])
+		rest := ab[len(ab)-ar.Len():]
+		if len(rest) > 0 && rf.mode&os.ModeSymlink > 0 {
+			// Read 0 terminated symlink name after the attributes
+			n := bytes.IndexByte(rest, 0)
+			if n < 0 {
+				n = len(rest)
+				rest = append(rest, 0)
 			}
+			rf.Symlink = string(rest[:n])
+			rest = rest[n+1:]
+			glg.Debugf("Read symlink: %s", rf.Symlink)
+		}
+		if len(rest) > 0 {
+			x, err := decodeXattrs(rest)
+			if err != nil {
+				glg.Warnf("leftover attributes: %v [% X]", len(rest), rest)
+				return fmt.Errorf("decoding xattrs: %v", err)
+			}
+			rf.Xattrs = x
 		}
 
 	}
 	return nil
 }
 
-func (b *BoxBackup) readDirStream(rd *Stream) ([]*RemoteFile, error) {
+func (b *BoxBackup) readDirStream(rd *Stream) (*RemoteFile, error) {
 	var ds proto.DirStream
 	binary.Read(rd, binary.BigEndian, &ds)
 	glg.Debugf("dir: %+v", ds)
 
 	rf := &RemoteFile{
+		Id:                ds.ObjectID,
 		ParentId:          ds.ContainerID,
 		AttributesModTime: time.Unix(int64(ds.AttributesModTime/1e6), 0),
 	}
@@ -351,6 +551,7 @@ func (b *BoxBackup) readDirStream(rd *Stream) ([]*RemoteFile, error) {
 			ModificationTime: time.Unix(int64(e.ModificationTime/1e6), 0),
 			size:             e.SizeInBlocks,
 			Flags:            e.Flags,
+			AttributesHash:   e.AttributesHash,
 		}
 		if err := b.readAttributes(rd, f); err != nil {
 			return nil, err
@@ -359,7 +560,7 @@ func (b *BoxBackup) readDirStream(rd *Stream) ([]*RemoteFile, error) {
 	}
 
 	// TODO: handle symbolic link filenames and xattrs.
-	return rf.entries, nil
+	return rf, nil
 }
 
 func (b *BoxBackup) readFileStream(rd *Stream, idx *blockIndex) {
@@ -399,9 +600,10 @@ func (b *BoxBackup) readFileStream(rd *Stream, idx *blockIndex) {
 
 	for i, ent := range idx.Blocks {
 		bs := idx.Sizes[i]
-		if bs < 0 {
-			// TODO: check for blocks from other files
-			glg.Warnf("Detected reference to a foreign block: %v", bs)
+		if bs <= 0 {
+			// Block is stored in the other file, nothing to check here.
+			glg.Debugf("block %v refers to block %v of %x", i, -bs, idx.Index.OtherFileID)
+			continue
 		}
 		glg.Debugf("processing entry: bs: %v, %+v", bs, ent)
 
@@ -426,6 +628,7 @@ func (b *BoxBackup) readStream() ([]*RemoteFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer s.Close()
 	p, err := s.Peek(4)
 	if err != nil {
 		return nil, err
@@ -441,7 +644,11 @@ func (b *BoxBackup) readStream() ([]*RemoteFile, error) {
 		b.readFileStream(s, idx)
 
 	case "DIR_":
-		return b.readDirStream(s)
+		d, err := b.readDirStream(s)
+		if err != nil {
+			return nil, err
+		}
+		return d.entries, nil
 
 	default:
 		return nil, fmt.Errorf("unknown stream magic: %s", m)
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"errors"
+	"testing"
+)
+
+func TestDecodeBlockEncodings(t *testing.T) {
+	bb, _ := newTestSession(t)
+	blk := newDiffBlock([]byte("some block data"))
+	aes, _ := bb.crypt.EncryptFileData(blk.data, make([]byte, 16))
+	bf, _ := bb.crypt.EncryptFileDataBF(blk.data, make([]byte, 8))
+
+	for _, tc := range []struct {
+		name string
+		buf  []byte
+		want error
+	}{
+		{"none", append([]byte{proto.BlockEncodingNone}, blk.data...), nil},
+		{"blowfish", append([]byte{proto.BlockEncodingBlowfish << 1}, bf...), nil},
+		{"aes", append([]byte{proto.BlockEncodingAES << 1}, aes...), nil},
+		{"aes marked as blowfish", append([]byte{proto.BlockEncodingBlowfish << 1}, aes...), nil},
+		{"short aes", []byte{proto.BlockEncodingAES << 1, 1, 2}, ErrCorrupt},
+		{"unknown", append([]byte{3 << 1}, aes...), ErrUnknownEncoding},
+	} {
+		d, err := bb.decodeBlock(tc.buf, &blk.entry)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.want)
+			continue
+		}
+		if err == nil && string(d) != string(blk.data) {
+			t.Errorf("%s: decoded %q", tc.name, d)
+		}
+	}
+}
+
+func TestCheckFileMagic(t *testing.T) {
+	for _, tc := range []struct {
+		file, index int32
+		ok          bool
+	}{
+		{proto.FileMagicV1, proto.BlockIndexMagicV1, true},
+		{proto.FileMagicV0, proto.BlockIndexMagicV0, false},
+		{proto.FileMagicV1, proto.BlockIndexMagicV0, false},
+		{0x4449525F, proto.BlockIndexMagicV1, false}, // directory
+		{proto.FileMagicV1, 0, false},
+	} {
+		err := checkFileMagic(tc.file, tc.index)
+		if (err == nil) != tc.ok || (err != nil && !errors.Is(err, ErrUnknownEncoding)) {
+			t.Errorf("checkFileMagic(%x, %x): %v", tc.file, tc.index, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"context"
+	"time"
+
+	"github.com/kpango/glg"
+)
+
+// Sends GetIsAlive whenever the session has not sent a command for interval,
+// as the server drops clients which stay quiet for too long. While the stream
+// of a reply is being read, such as a file piped into a slow reader, the
+// message is queued behind it and its reply is read after the stream. A zero
+// interval stops sending them.
+func (b *BoxBackup) KeepAlive(interval time.Duration) {
+	b.aliveMu.Lock()
+	defer b.aliveMu.Unlock()
+	if b.stopAlive != nil {
+		close(b.stopAlive)
+		b.stopAlive = nil
+	}
+	if interval > 0 {
+		b.stopAlive = make(chan struct{})
+		go b.keepAliveLoop(interval, b.stopAlive)
+	}
+}
+
+func (b *BoxBackup) keepAliveLoop(interval time.Duration, stop chan struct{}) {
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		b.aliveMu.Lock()
+		idle := time.Since(b.lastUsed)
+		b.aliveMu.Unlock()
+		next := interval - idle
+		if next <= 0 {
+			b.sendAlive(interval)
+			next = interval
+		}
+		t.Reset(next)
+	}
+}
+
+// Sends GetIsAlive on an idle session, or queues it behind a stream being
+// read. Does nothing while a command is running.
+func (b *BoxBackup) sendAlive(timeout time.Duration) {
+	select {
+	case b.sem <- struct{}{}:
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := b.prepare(ctx); err != nil {
+			glg.Warnf("Keepalive failed: %s", err)
+			return
+		}
+		if _, err := b.execute(&Operation{Op: proto.GetIsAlive{}}); err != nil {
+			glg.Warnf("Keepalive failed: %s", err)
+		}
+		b.unlock()
+		return
+	default:
+	}
+
+	b.aliveMu.Lock()
+	defer b.aliveMu.Unlock()
+	if !b.streaming || b.Broken() != nil {
+		return
+	}
+	glg.Debug("Queueing keepalive behind the stream")
+	if _, err := sendCommand(b.conn, &Operation{Op: proto.GetIsAlive{}}); err != nil {
+		b.fail(err)
+		return
+	}
+	b.aliveOwed++
+	b.lastUsed = time.Now()
+}
+
+// Reads the replies queued behind the stream which was just read, and lets the
+// session run the next command.
+func (b *BoxBackup) endStream() {
+	b.aliveMu.Lock()
+	owed := b.aliveOwed
+	b.streaming = false
+	b.aliveOwed = 0
+	b.aliveMu.Unlock()
+
+	for ; owed > 0 && b.Broken() == nil; owed-- {
+		exp := proto.Commands["proto.GetIsAlive"][1]
+		if _, err := getResponse(b.conn, exp); err != nil {
+			b.fail(err)
+		}
+	}
+	b.unlock()
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveIdle(t *testing.T) {
+	bb, ts := newTestStore(t)
+
+	bb.KeepAlive(5 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	bb.KeepAlive(0)
+	// Waits for a keepalive still running.
+	if _, err := bb.ReadDir(1); err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if ts.alive == 0 {
+		t.Errorf("No keepalive sent while idle")
+	}
+}
+
+func TestKeepAliveStream(t *testing.T) {
+	bb, ts := newTestStore(t)
+	data := bytes.Repeat([]byte("keepalive"), 1000)
+	ts.addFile(1, 2, "f", data)
+
+	f, err := bb.OpenFile(1, 2)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		bb.sendAlive(time.Second)
+	}()
+	// Let the keepalive queue up behind the stream.
+	got := make([]byte, 100)
+	if _, err := io.ReadFull(f, got); err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	rest, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	if !bytes.Equal(append(got, rest...), data) {
+		t.Errorf("File data differs")
+	}
+	f.Close()
+	<-done
+
+	if _, err := bb.ReadDir(1); err != nil {
+		t.Fatalf("ReadDir after the stream: %s", err)
+	}
+	if ts.alive != 1 {
+		t.Errorf("Expected 1 keepalive, got %v", ts.alive)
+	}
+}
@@ -0,0 +1,262 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ID of the root directory of the store.
+const RootDirectory = 1
+
+// Directory listings and paths shared by Resolve and PathOf. Commands which
+// change a directory drop it from the cache.
+type dirCache struct {
+	mu    sync.Mutex
+	dirs  map[int64]*RemoteFile // listed directories with their entries
+	ents  map[int64]*RemoteFile // entries seen in the listings
+	paths map[int64]string
+}
+
+func newDirCache() *dirCache {
+	c := &dirCache{}
+	c.clear()
+	return c
+}
+
+func (c *dirCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirs = make(map[int64]*RemoteFile)
+	c.ents = make(map[int64]*RemoteFile)
+	c.paths = make(map[int64]string)
+}
+
+func (c *dirCache) add(d *RemoteFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirs[d.Id] = d
+	for _, e := range d.entries {
+		c.ents[e.Id] = e
+	}
+}
+
+func (c *dirCache) dir(id int64) (*RemoteFile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.dirs[id]
+	return d, ok
+}
+
+func (c *dirCache) entry(id int64) (*RemoteFile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.ents[id]
+	return e, ok
+}
+
+func (c *dirCache) path(id int64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.paths[id]
+	return p, ok
+}
+
+func (c *dirCache) setPath(id int64, p string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths[id] = p
+}
+
+// Drops listings of the given directories. Paths of everything below them
+// might have changed as well.
+func (c *dirCache) forget(ids ...int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		if d, ok := c.dirs[id]; ok {
+			for _, e := range d.entries {
+				delete(c.ents, e.Id)
+			}
+			delete(c.dirs, id)
+		}
+	}
+	c.paths = make(map[int64]string)
+}
+
+// Drops a single entry, which moved elsewhere.
+func (c *dirCache) forgetEntry(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ents, id)
+}
+
+// Drops the listing of directory id and of its container, if known.
+func (b *BoxBackup) forgetDir(id int64) {
+	if e, ok := b.cache.entry(id); ok {
+		b.cache.forget(e.ParentId)
+	}
+	b.cache.forget(id)
+}
+
+// Entry standing for the root directory, which is not listed anywhere.
+func rootEntry() *RemoteFile {
+	return &RemoteFile{
+		name:  "/",
+		Id:    RootDirectory,
+		Flags: proto.Flags_Dir,
+		mode:  os.ModeDir | 0o755,
+	}
+}
+
+// Drops all cached listings and paths.
+func (b *BoxBackup) ClearCache() {
+	b.cache.clear()
+}
+
+// Returns the listing of directory id, reading it from the store only if it
+// is not cached yet.
+func (b *BoxBackup) ReadDirCached(id int64) ([]*RemoteFile, error) {
+	d, err := b.cachedDir(id)
+	if err != nil {
+		return nil, err
+	}
+	return d.entries, nil
+}
+
+func (b *BoxBackup) cachedDir(id int64) (*RemoteFile, error) {
+	if d, ok := b.cache.dir(id); ok {
+		return d, nil
+	}
+	d, err := b.listDirectory(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	b.cache.add(d)
+	return d, nil
+}
+
+// Returns the ID of the directory containing directory id.
+func (b *BoxBackup) parentOf(id int64) (int64, error) {
+	if id == RootDirectory {
+		return id, nil
+	}
+	if e, ok := b.cache.entry(id); ok {
+		return e.ParentId, nil
+	}
+	d, err := b.cachedDir(id)
+	if err != nil {
+		return 0, err
+	}
+	return d.ParentId, nil
+}
+
+// Looks up the entry for a slash separated path, starting from the root
+// directory. See ResolveFrom.
+func (b *BoxBackup) Resolve(path string) (*RemoteFile, error) {
+	return b.ResolveFrom(RootDirectory, path)
+}
+
+// Looks up the entry for a slash separated path relative to directory dir, or
+// to the root directory if the path starts with a slash. Only current entries
+// are found, not deleted ones or old versions. Components "." and ".." work as
+// usual, names can contain any characters other than a slash.
+func (b *BoxBackup) ResolveFrom(dir int64, path string) (*RemoteFile, error) {
+	if strings.HasPrefix(path, "/") {
+		dir = RootDirectory
+	}
+	e := rootEntry()
+	if dir != RootDirectory {
+		id, err := b.parentOf(dir)
+		if err != nil {
+			return nil, err
+		}
+		if e, err = b.findEntry(id, func(c *RemoteFile) bool {
+			return c.Id == dir
+		}); err != nil {
+			return nil, err
+		}
+		if e == nil {
+			return nil, fmt.Errorf("directory %x: %w", dir, os.ErrNotExist)
+		}
+	}
+
+	for _, n := range strings.Split(path, "/") {
+		if n == "" || n == "." {
+			continue
+		}
+		if !e.IsDir() {
+			return nil, fmt.Errorf("%s: %s is not a directory", path, e.Name())
+		}
+		if n == ".." {
+			if e.Id == RootDirectory {
+				continue
+			}
+			p, err := b.parentOf(e.Id)
+			if err != nil {
+				return nil, err
+			}
+			if e, err = b.ResolveFrom(p, "."); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		c, err := b.findEntry(e.Id, func(c *RemoteFile) bool {
+			return c.Flags&(proto.Flags_Deleted|proto.Flags_OldVersion) == 0 && c.Name() == n
+		})
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			return nil, fmt.Errorf("%s: can not find %s: %w", path, n, os.ErrNotExist)
+		}
+		e = c
+	}
+	return e, nil
+}
+
+func (b *BoxBackup) findEntry(dir int64, match func(*RemoteFile) bool) (*RemoteFile, error) {
+	de, err := b.ReadDirCached(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range de {
+		if match(e) {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the absolute path of object id. Files are only found if the listing
+// of their directory is cached, directories always.
+func (b *BoxBackup) PathOf(id int64) (string, error) {
+	if id == RootDirectory {
+		return "/", nil
+	}
+	if p, ok := b.cache.path(id); ok {
+		return p, nil
+	}
+
+	// Without the containing directory only a directory name can be found.
+	d, o := id, int64(0)
+	if e, ok := b.cache.entry(id); ok {
+		d, o = e.ParentId, id
+	}
+	n, err := b.GetObjectName(d, o)
+	if err != nil {
+		return "", err
+	}
+	// Name elements come starting with the object itself.
+	var r []string
+	for _, s := range n {
+		r = append([]string{s}, r...)
+	}
+	p := "/" + strings.Join(r, "/")
+	b.cache.setPath(id, p)
+	return p, nil
+}
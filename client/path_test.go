@@ -0,0 +1,82 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	bb, ts := newTestStore(t)
+	ts.addDir(1, 2, "home")
+	ts.addDir(2, 3, "my docs")
+	ts.addFile(3, 4, "a b.txt", []byte("x"))
+	ts.addFile(3, 5, "gone", []byte("x")).Flags |= proto.Flags_Deleted
+	ts.addDir(1, 6, "tmp")
+
+	for _, tc := range []struct {
+		dir  int64
+		path string
+		id   int64
+	}{
+		{1, "/", 1},
+		{1, "home", 2},
+		{1, "/home/my docs/a b.txt", 4},
+		{1, "home//my docs/./a b.txt", 4},
+		{3, "a b.txt", 4},
+		{3, "..", 2},
+		{3, "../..", 1},
+		{3, "../../..", 1},
+		{3, "../../tmp", 6},
+		{6, "/home/my docs", 3},
+		{4, ".", 4},
+	} {
+		e, err := bb.ResolveFrom(tc.dir, tc.path)
+		if err != nil {
+			t.Errorf("ResolveFrom(%x, %q): %s", tc.dir, tc.path, err)
+			continue
+		}
+		if e.Id != tc.id {
+			t.Errorf("ResolveFrom(%x, %q) = %x, want %x", tc.dir, tc.path, e.Id, tc.id)
+		}
+	}
+
+	for _, p := range []string{"nothing", "home/my docs/gone", "home/my docs/a b.txt/x"} {
+		if e, err := bb.Resolve(p); err == nil {
+			t.Errorf("Resolve(%q) = %x, want error", p, e.Id)
+		}
+	}
+	if _, err := bb.Resolve("/home/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Resolve of missing entry: %v", err)
+	}
+}
+
+func TestPathOf(t *testing.T) {
+	bb, ts := newTestStore(t)
+	ts.addDir(1, 2, "home")
+	ts.addDir(2, 3, "my docs")
+	ts.addFile(3, 4, "a b.txt", []byte("x"))
+
+	if p, err := bb.PathOf(3); err != nil || p != "/home/my docs" {
+		t.Errorf("PathOf directory: %q, %v", p, err)
+	}
+	// File names need the listing of their directory.
+	if _, err := bb.ReadDirCached(3); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := bb.PathOf(4); err != nil || p != "/home/my docs/a b.txt" {
+		t.Errorf("PathOf file: %q, %v", p, err)
+	}
+	if p, err := bb.PathOf(1); err != nil || p != "/" {
+		t.Errorf("PathOf root: %q, %v", p, err)
+	}
+
+	e, err := bb.Resolve("/home/my docs/a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := bb.PathOf(e.Id); err != nil || p != "/home/my docs/a b.txt" {
+		t.Errorf("PathOf resolved file: %q, %v", p, err)
+	}
+}
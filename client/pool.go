@@ -0,0 +1,119 @@
+package client
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kpango/glg"
+)
+
+// Opens a new session to the store and logs in.
+type DialFunc func() (*BoxBackup, error)
+
+// Pool keeps logged in sessions to the same store, so that independent
+// requests from several goroutines can run in parallel, such as those of a web
+// server or a parallel restore. At most max sessions are open at a time.
+type Pool struct {
+	dial  DialFunc
+	slots chan struct{} // one for each session in use
+
+	mu     sync.Mutex
+	idle   []*BoxBackup
+	closed bool
+}
+
+// Returns a pool of up to max sessions, opened with dial when needed.
+func NewPool(max int, dial DialFunc) *Pool {
+	if max < 1 {
+		max = 1
+	}
+	return &Pool{
+		dial:  dial,
+		slots: make(chan struct{}, max),
+	}
+}
+
+// Returns a session for the sole use of the caller, waiting while all of them
+// are busy. The session has to be returned with Put.
+func (p *Pool) Get() (*BoxBackup, error) {
+	p.slots <- struct{}{}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, errors.New("session pool is closed")
+	}
+	if n := len(p.idle); n > 0 {
+		b := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return b, nil
+	}
+	p.mu.Unlock()
+
+	b, err := p.dial()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return b, nil
+}
+
+// Returns a session taken with Get. Sessions which failed with an error
+// should be passed to Discard instead.
+func (p *Pool) Put(b *BoxBackup) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.finish(b)
+	} else {
+		p.idle = append(p.idle, b)
+		p.mu.Unlock()
+	}
+	<-p.slots
+}
+
+// Closes a session taken with Get, which might be in an unknown state.
+func (p *Pool) Discard(b *BoxBackup) {
+	b.Close()
+	<-p.slots
+}
+
+// Runs fn with a session from the pool. The session is discarded if fn fails,
+// as it might have been left in the middle of a reply, unless the error is a
+// reply of the server which completed the exchange.
+func (p *Pool) Do(fn func(b *BoxBackup) error) error {
+	b, err := p.Get()
+	if err != nil {
+		return err
+	}
+	var pe *ProtocolError
+	if err = fn(b); err != nil && (!errors.As(err, &pe) || b.Broken() != nil) {
+		p.Discard(b)
+	} else {
+		p.Put(b)
+	}
+	return err
+}
+
+// Logs out of the idle sessions. Sessions still in use are closed when they
+// are returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, b := range idle {
+		p.finish(b)
+	}
+	return nil
+}
+
+func (p *Pool) finish(b *BoxBackup) {
+	if err := b.Finish(); err != nil {
+		glg.Warnf("Unable to log out: %s", err)
+	}
+	b.Close()
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func testFiles(ts *testStore, n int) map[int64][]byte {
+	files := make(map[int64][]byte)
+	for i := 0; i < n; i++ {
+		id := int64(i + 2)
+		files[id] = bytes.Repeat([]byte{byte(i)}, 3000+i)
+		ts.addFile(1, id, fmt.Sprintf("f%v", i), files[id])
+	}
+	return files
+}
+
+func readTestFile(bb *BoxBackup, id int64, want []byte) error {
+	f, err := bb.OpenFile(1, id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("file %x: read %v bytes, want %v", id, len(got), len(want))
+	}
+	return nil
+}
+
+func TestSessionConcurrent(t *testing.T) {
+	bb, ts := newTestStore(t)
+	files := testFiles(ts, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		for id, data := range files {
+			wg.Add(2)
+			go func(id int64, data []byte) {
+				defer wg.Done()
+				if err := readTestFile(bb, id, data); err != nil {
+					t.Error(err)
+				}
+			}(id, data)
+			go func() {
+				defer wg.Done()
+				if de, err := bb.ReadDir(1); err != nil || len(de) != len(files) {
+					t.Errorf("ReadDir: %v entries, %v", len(de), err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestPool(t *testing.T) {
+	_, ts := newTestStore(t)
+	files := testFiles(ts, 6)
+
+	var mu sync.Mutex
+	opened := 0
+	p := NewPool(3, func() (*BoxBackup, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		opened++
+		return ts.session(), nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		for id, data := range files {
+			wg.Add(1)
+			go func(id int64, data []byte) {
+				defer wg.Done()
+				if err := p.Do(func(bb *BoxBackup) error {
+					return readTestFile(bb, id, data)
+				}); err != nil {
+					t.Error(err)
+				}
+			}(id, data)
+		}
+	}
+	wg.Wait()
+	if opened > 3 {
+		t.Errorf("Opened %v sessions, at most 3 expected", opened)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	if _, err := p.Get(); err == nil {
+		t.Errorf("Get from a closed pool succeeded")
+	}
+}
@@ -1,5 +1,13 @@
 package proto
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+)
+
 var Handshake = "Box-Backup:v=C"
 
 const HandshakeLen = 32
@@ -15,15 +23,15 @@ var Commands = map[string][2]uint32{
 	"proto.SetClientStoreMarker": {6, 0},
 
 	"proto.GetObject":     {10, 5},
-	"proto.MoveObject":    {11, 0},
+	"proto.MoveObject":    {11, 5},
 	"proto.GetObjectName": {12, 13},
 	"proto.ObjectName":    {13, 0},
 
-	"proto.CreateDirectory":     {20, 0},
+	"proto.CreateDirectory":     {20, 5},
 	"proto.ListDirectory":       {21, 5},
-	"proto.ChangeDirAttributes": {22, 0},
-	"proto.DeleteDirectory":     {23, 0},
-	"proto.UndeleteDirectory":   {24, 0},
+	"proto.ChangeDirAttributes": {22, 5},
+	"proto.DeleteDirectory":     {23, 5},
+	"proto.UndeleteDirectory":   {24, 5},
 
 	"proto.StoreFile":                    {30, 5},
 	"proto.GetFile":                      {31, 5},
@@ -31,16 +39,16 @@ var Commands = map[string][2]uint32{
 	"proto.DeleteFile":                   {33, 5},
 	"proto.GetBlockIndexByID":            {34, 5},
 	"proto.GetBlockIndexByName":          {35, 5},
-	"proto.UndeleteFile":                 {36, 0},
+	"proto.UndeleteFile":                 {36, 5},
 
 	"proto.GetAccountUsage":  {40, 41},
 	"proto.AccountUsage":     {41, 0},
-	"proto.GetIsAlive":       {42, 0},
+	"proto.GetIsAlive":       {42, 43},
 	"proto.IsAlive":          {43, 0},
 	"proto.GetAccountUsage2": {44, 45},
 	"proto.AccountUsage2":    {45, 0},
 
-	"proto.CreateDirectory2": {46, 0},
+	"proto.CreateDirectory2": {46, 5},
 }
 
 var factory = map[uint32]interface{}{
@@ -80,9 +88,14 @@ var factory = map[uint32]interface{}{
 	46: &CreateDirectory2{},
 }
 
+// Returns a new instance of the command, so that replies on several sessions
+// can be decoded at the same time.
 func GetCommand(id uint32) (interface{}, bool) {
 	r, ok := factory[id]
-	return r, ok
+	if !ok {
+		return nil, false
+	}
+	return reflect.New(reflect.TypeOf(r).Elem()).Interface(), true
 }
 
 type Header struct {
@@ -167,6 +180,23 @@ type FileBlockIndex struct {
 	NumBlocks   int64   // repeat of value in file header
 }
 
+// Magic values of file streams and block indexes. Files stored by the earliest
+// bbackupd releases use the V0 values.
+const (
+	FileMagicV0       = 0x46494C45 // OBJECTMAGIC_FILE_MAGIC_VALUE_V0
+	FileMagicV1       = 0x66696C65 // OBJECTMAGIC_FILE_MAGIC_VALUE_V1
+	BlockIndexMagicV0 = 0x46426C6B // OBJECTMAGIC_FILE_BLOCKS_MAGIC_VALUE_V0
+	BlockIndexMagicV1 = 0x62696478 // OBJECTMAGIC_FILE_BLOCKS_MAGIC_VALUE_V1
+)
+
+// Block encodings, in the upper bits of the block header byte. The lowest bit
+// is set for compressed blocks.
+const (
+	BlockEncodingNone     = 0
+	BlockEncodingBlowfish = 1
+	BlockEncodingAES      = 2
+)
+
 //
 // FileBlockIndex is followed by the blocks, where each FileBlockIndexEntry is
 // prefixed by the 8 byte header, which is either size or a block number in
@@ -193,12 +223,16 @@ type MoveObject struct {
 	MoveToDirectory   int64
 	Flags             int32
 	// Filename	NewFilename
-	// CONSTANT Flags_MoveAllWithSameName			1
-	// CONSTANT Flags_AllowMoveOverDeletedObject	2
 	// # consider this an object command as, although it deals with directory entries,
 	// # it's not specific to either a file or a directory
 }
 
+// Flags for MoveObject
+const (
+	Flags_MoveAllWithSameName        = 1
+	Flags_AllowMoveOverDeletedObject = 2
+)
+
 type GetObjectName struct {
 	ObjectID              int64
 	ContainingDirectoryID int64
@@ -259,6 +293,14 @@ type ListDirectory struct {
 	*/
 }
 
+// Flags of directory entries
+const (
+	Flags_File       = 1
+	Flags_Dir        = 2
+	Flags_Deleted    = 4
+	Flags_OldVersion = 8
+)
+
 type DirStream struct {
 	MagicValue        int32 // also the version number
 	NumEntries        int32
@@ -428,8 +470,12 @@ type GetAccountUsage2 struct {
 }
 
 type AccountUsage2 struct {
-	//String	AccountName
-	Padding              uint32 // maybe number of accounts?
+	AccountName string
+	AccountUsage2Info
+}
+
+// Fixed size part of AccountUsage2, following the account name.
+type AccountUsage2Info struct {
 	AccountEnabled       bool
 	ClientStoreMarker    int64
 	BlockSize            int32
@@ -446,3 +492,31 @@ type AccountUsage2 struct {
 	NumDeletedFiles      int64
 	NumDirectories       int64
 }
+
+// Decodes the reply, which starts with the length of the account name.
+func (u *AccountUsage2) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	if int64(n) > int64(r.Len()) {
+		return fmt.Errorf("account name of %v bytes is longer than the reply", n)
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return err
+	}
+	u.AccountName = string(name)
+	return binary.Read(r, binary.BigEndian, &u.AccountUsage2Info)
+}
+
+func (u AccountUsage2) MarshalBinary() ([]byte, error) {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, uint32(len(u.AccountName)))
+	b.WriteString(u.AccountName)
+	if err := binary.Write(b, binary.BigEndian, &u.AccountUsage2Info); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/kpango/glg"
+)
+
+var _ io.ReaderAt = (*RemoteFile)(nil)
+var _ io.Seeker = (*RemoteFile)(nil)
+
+// Opens file id in directory d for reading with ReadAt and Seek, as needed by
+// io.ReaderAt users such as archive readers and http.ServeContent. Only the
+// block index is fetched up front, the file data is requested on the first
+// read. Size returns the size of the file data in bytes.
+//
+// This does not download less than OpenFile: the protocol has no command for
+// fetching single blocks, so reaching a block still transfers all the data
+// before it. The encoded blocks passed on the way are kept in a temporary file
+// until Close, so reading backwards does not download them again.
+//
+// From the first read until Close, the stream of the file holds the session:
+// other commands on it wait until the file is closed, so use another session,
+// such as from a Pool, meanwhile.
+func (b *BoxBackup) OpenFileRandom(d, id int64) (*RemoteFile, error) {
+	return b.OpenFileRandomContext(context.Background(), d, id)
+}
+
+// Context variant of OpenFileRandom. The context also applies to the requests
+// for the file data made by later reads.
+func (b *BoxBackup) OpenFileRandomContext(ctx context.Context, d, id int64) (*RemoteFile, error) {
+	idx, err := b.blockIndexByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	f := &RemoteFile{
+		ctx:       ctx,
+		Id:        id,
+		ParentId:  d,
+		boxBackup: b,
+		idx:       idx,
+	}
+	f.startRandom()
+	f.size = f.offsets[len(f.offsets)-1]
+	return f, nil
+}
+
+// Switches the file to random access, keeping the current position.
+func (f *RemoteFile) startRandom() {
+	if f.offsets != nil {
+		return
+	}
+	f.offsets = make([]int64, len(f.idx.Blocks)+1)
+	for i, e := range f.idx.Blocks {
+		f.offsets[i+1] = f.offsets[i] + int64(e.Size)
+	}
+}
+
+// Requests the file data again, starting from the first block.
+func (f *RemoteFile) reopen() error {
+	if f.remote != nil {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	glg.Debugf("Requesting file %x from the start", f.Id)
+	ctx := f.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	f.remote = nil
+	if f.spool == nil {
+		var err error
+		if f.spool, err = ioutil.TempFile("", "bbq-"); err != nil {
+			return err
+		}
+	} else if err := f.spool.Truncate(0); err != nil {
+		return err
+	} else if _, err := f.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if need := f.idx.foreignNeeded(); len(need) > 0 && f.foreign == nil {
+		// The index is known already, so the blocks of the other file can be
+		// fetched before the stream of this one.
+		foreign, err := f.boxBackup.foreignBlocks(ctx, f.idx.Index.OtherFileID, need,
+			map[int64]bool{f.Id: true})
+		if err != nil {
+			return fmt.Errorf("read foreign blocks: %w", err)
+		}
+		f.foreign = foreign
+	}
+	nf, err := f.boxBackup.getFileStream(ctx, f.ParentId, f.Id)
+	if err != nil {
+		return err
+	}
+	if nf.idx.Index.NumBlocks != f.idx.Index.NumBlocks {
+		nf.Close()
+		return fmt.Errorf("file %x changed while reading", f.Id)
+	}
+	f.remote = nf.remote
+	f.fileStream = nf.fileStream
+	f.name = nf.name
+	f.mode = nf.mode
+	f.UID, f.GID = nf.UID, nf.GID
+	f.ModificationTime = nf.ModificationTime
+	f.AttributesModTime = nf.AttributesModTime
+	f.Symlink = nf.Symlink
+	f.Xattrs = nf.Xattrs
+	f.curBlock = 0
+	f.block = nil
+	return nil
+}
+
+// Returns decoded block n, reading the stream up to it.
+func (f *RemoteFile) blockAt(n int64) ([]byte, error) {
+	if n == f.curBlock-1 && f.block != nil {
+		return f.block, nil
+	}
+	if n < f.curBlock && f.spool != nil {
+		return f.spooledBlock(n)
+	}
+	if f.remote == nil || n < f.curBlock {
+		if err := f.reopen(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the blocks before without decoding them. Files switched to random
+	// access after reading them in sequence have nothing kept until they are
+	// requested again.
+	var spool io.Writer = ioutil.Discard
+	if f.spool != nil {
+		spool = f.spool
+	}
+	for ; f.curBlock < n; f.curBlock++ {
+		if s := f.idx.Sizes[f.curBlock]; s > 0 {
+			if _, err := io.CopyN(spool, f.remote, s); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	s := f.idx.Sizes[n]
+	blk := f.idx.Blocks[n]
+	var err error
+	if s <= 0 {
+		f.block, err = f.foreignBlock(s, &blk)
+	} else {
+		buf := make([]byte, s)
+		if _, err = io.ReadFull(f.remote, buf); err != nil {
+			return nil, err
+		}
+		if _, err = spool.Write(buf); err != nil {
+			return nil, err
+		}
+		f.block, err = f.boxBackup.decodeBlock(buf, &blk)
+	}
+	f.curBlock = n + 1
+	if err != nil {
+		f.block = nil
+		return nil, err
+	}
+	return f.block, nil
+}
+
+// Returns decoded block n from the blocks read before.
+func (f *RemoteFile) spooledBlock(n int64) ([]byte, error) {
+	s := f.idx.Sizes[n]
+	blk := f.idx.Blocks[n]
+	if s <= 0 {
+		return f.foreignBlock(s, &blk)
+	}
+	var off int64
+	for _, p := range f.idx.Sizes[:n] {
+		if p > 0 {
+			off += p
+		}
+	}
+	buf := make([]byte, s)
+	if _, err := f.spool.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	return f.boxBackup.decodeBlock(buf, &blk)
+}
+
+// Reads len(p) bytes from offset off of the file data. Calls are serialized,
+// as all of them use the same stream.
+func (f *RemoteFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.startRandom()
+	return f.readAt(p, off)
+}
+
+func (f *RemoteFile) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	size := f.offsets[len(f.offsets)-1]
+	var i int
+	for i < len(p) {
+		if off >= size {
+			return i, io.EOF
+		}
+		// First block ending after the offset.
+		n := sort.Search(len(f.idx.Blocks), func(n int) bool {
+			return f.offsets[n+1] > off
+		})
+		d, err := f.blockAt(int64(n))
+		if err != nil {
+			return i, err
+		}
+		c := copy(p[i:], d[off-f.offsets[n]:])
+		i += c
+		off += int64(c)
+	}
+	return i, nil
+}
+
+// Sets the offset for the next Read.
+func (f *RemoteFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.startRandom()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.offsets[len(f.offsets)-1]
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
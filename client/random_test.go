@@ -0,0 +1,92 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadAt(t *testing.T) {
+	bb, ts := newTestStore(t)
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	ts.addFile(1, 2, "f", data)
+
+	f, err := bb.OpenFileRandom(1, 2)
+	if err != nil {
+		t.Fatalf("OpenFileRandom: %s", err)
+	}
+	defer f.Close()
+	if f.Size() != int64(len(data)) {
+		t.Errorf("Size = %v, want %v", f.Size(), len(data))
+	}
+
+	for _, tc := range []struct {
+		off int64
+		n   int
+	}{
+		{3000, 100}, // within a block
+		{1000, 100}, // across blocks, backwards
+		{4990, 10},  // up to the end
+		{0, 5000},
+	} {
+		p := make([]byte, tc.n)
+		if n, err := f.ReadAt(p, tc.off); err != nil || n != tc.n {
+			t.Errorf("ReadAt(%v): %v, %v", tc.off, n, err)
+			continue
+		}
+		if !bytes.Equal(p, data[tc.off:tc.off+int64(tc.n)]) {
+			t.Errorf("ReadAt(%v) returned wrong data", tc.off)
+		}
+	}
+
+	if ts.files != 1 {
+		t.Errorf("Requested the file %v times, want once", ts.files)
+	}
+
+	p := make([]byte, 20)
+	if n, err := f.ReadAt(p, 4990); err != io.EOF || n != 10 {
+		t.Errorf("ReadAt past the end: %v, %v", n, err)
+	}
+
+	if o, err := f.Seek(-100, io.SeekEnd); err != nil || o != 4900 {
+		t.Fatalf("Seek: %v, %v", o, err)
+	}
+	tail, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(tail, data[4900:]) {
+		t.Errorf("Reading the tail: %v bytes, %v", len(tail), err)
+	}
+
+	spool := f.spool.Name()
+	f.Close()
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("Kept blocks after Close: %v", err)
+	}
+}
+
+func TestSeekSequential(t *testing.T) {
+	bb, ts := newTestStore(t)
+	data := bytes.Repeat([]byte("abcdefghij"), 300)
+	ts.addFile(1, 2, "f", data)
+
+	f, err := bb.OpenFile(1, 2)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+	p := make([]byte, 1500)
+	if _, err := io.ReadFull(f, p); err != nil {
+		t.Fatal(err)
+	}
+	if o, err := f.Seek(-10, io.SeekCurrent); err != nil || o != 1490 {
+		t.Fatalf("Seek: %v, %v", o, err)
+	}
+	rest, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(rest, data[1490:]) {
+		t.Errorf("Reading after seek: %v bytes, %v", len(rest), err)
+	}
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/kpango/glg"
+)
+
+// Read commands which are sent again after reconnecting, as repeating them
+// does not change the store.
+var idempotent = map[string]bool{
+	"proto.ListDirectory":       true,
+	"proto.GetObjectName":       true,
+	"proto.GetFile":             true,
+	"proto.GetObject":           true,
+	"proto.GetBlockIndexByID":   true,
+	"proto.GetBlockIndexByName": true,
+	"proto.GetIsAlive":          true,
+}
+
+// Times a read command is retried and the wait before the first retry, which
+// doubles for each further one.
+var (
+	maxRetries = 3
+	retryDelay = 500 * time.Millisecond
+)
+
+// Lets the session reconnect with dial, such as a closure around
+// StoreConnection.Connect, after its connection fails. The next command opens
+// a new connection and repeats the version check and login done before.
+//
+// Read commands failing on the connection are retried a few times with
+// backoff. Other commands return the error, as the server might have applied
+// them already. Streams are not resumed: a file whose data was being read has
+// to be opened again.
+func (b *BoxBackup) SetDialer(dial func() (net.Conn, error)) {
+	b.sem <- struct{}{}
+	b.dial = dial
+	<-b.sem
+}
+
+// Closes the connection and opens a new one with the dialer, logging in again.
+func (b *BoxBackup) Reconnect() error {
+	return b.ReconnectContext(context.Background())
+}
+
+// Context variant of Reconnect.
+func (b *BoxBackup) ReconnectContext(ctx context.Context) error {
+	if b.dial == nil {
+		return errors.New("reconnect: session has no dialer")
+	}
+	select {
+	case b.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-b.sem }()
+	return b.redial(ctx)
+}
+
+// Replaces the connection of the reserved session and restores its state.
+func (b *BoxBackup) redial(ctx context.Context) error {
+	if err := b.Broken(); err != nil {
+		glg.Warnf("Reconnecting after: %s", err)
+	}
+	b.conn.Close()
+	c, err := b.dial()
+	if err != nil {
+		return b.fail(fmt.Errorf("reconnect: %w", err))
+	}
+	b.conn = c
+	b.ready = false
+	b.stateMu.Lock()
+	b.broken = nil
+	version, login := b.version, b.login
+	b.stateMu.Unlock()
+
+	b.ctx = ctx
+	unwatch := b.watch(ctx)
+	defer func() {
+		unwatch()
+		b.ctx = nil
+	}()
+	if version != 0 {
+		if _, err := b.execute(&Operation{Op: proto.Version{Version: version}}); err != nil {
+			return b.fail(fmt.Errorf("version check failed: %w", err))
+		}
+	}
+	if login != nil {
+		if _, err := b.execute(&Operation{Op: *login}); err != nil {
+			return b.fail(fmt.Errorf("login failed: %w", err))
+		}
+	}
+	glg.Info("Reconnected")
+	return nil
+}
+
+// Reconnects the reserved session after op failed on the connection, if it
+// can be sent again. Returns whether to retry it.
+func (b *BoxBackup) retry(ctx context.Context, op *Operation, n int) bool {
+	if b.dial == nil || n >= maxRetries || b.Broken() == nil ||
+		!idempotent[reflect.TypeOf(op.Op).String()] {
+		return false
+	}
+	b.unwatch()
+	b.unwatch = func() {}
+	t := time.NewTimer(retryDelay << n)
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		t.Stop()
+		return false
+	}
+	if err := b.redial(ctx); err != nil {
+		glg.Warnf("Unable to reconnect: %s", err)
+	}
+	b.ctx = ctx
+	b.unwatch = b.watch(ctx)
+	return true
+}
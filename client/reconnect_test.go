@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+	bb, ts := newTestStore(t)
+	ts.addFile(1, 2, "f", []byte("data"))
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	dials := 0
+	bb.SetDialer(func() (net.Conn, error) {
+		dials++
+		s, c := net.Pipe()
+		t.Cleanup(func() {
+			s.Close()
+			c.Close()
+		})
+		go func() {
+			// Answer the handshake, then serve the store.
+			hs := make([]byte, proto.HandshakeLen)
+			if _, err := io.ReadFull(s, hs); err != nil {
+				return
+			}
+			s.Write(hs)
+			ts.serve(s)
+		}()
+		return c, nil
+	})
+
+	// Reads are sent again on a new connection.
+	bb.conn.Close()
+	if de, err := bb.ReadDir(1); err != nil || len(de) != 1 {
+		t.Errorf("ReadDir after connection loss: %v entries, %v", len(de), err)
+	}
+	if dials != 1 {
+		t.Errorf("Expected 1 reconnect, got %v", dials)
+	}
+
+	// Writes fail, and the next command reconnects.
+	bb.conn.Close()
+	if err := bb.DeleteDirectory(5); err == nil || errors.Is(err, ErrDoesNotExist) {
+		t.Errorf("DeleteDirectory should fail on the connection, got %v", err)
+	}
+	if bb.Broken() == nil {
+		t.Errorf("Session should be broken after the failed write")
+	}
+	if de, err := bb.ReadDir(1); err != nil || len(de) != 1 {
+		t.Errorf("ReadDir after failed write: %v entries, %v", len(de), err)
+	}
+	if dials != 2 {
+		t.Errorf("Expected 2 reconnects, got %v", dials)
+	}
+}
@@ -0,0 +1,320 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kpango/glg"
+)
+
+// RestoreOptions select which entries are restored from the store.
+type RestoreOptions struct {
+	// Restore deleted entries when there is no current one with the same name.
+	IncludeDeleted bool
+	// Restore old versions of files next to the current one, as name.0x<id>.
+	IncludeOld bool
+	// Skip files which already exist locally with the same modification time
+	// and size.
+	Resume bool
+	// Restore the tree as it looked at this time, see AsOf. Other selection
+	// options are ignored when set.
+	AsOf time.Time
+	// Called after each restored entry.
+	Progress func(path string, f *RemoteFile)
+}
+
+type restorer struct {
+	b      *BoxBackup
+	opts   *RestoreOptions
+	failed int
+	// Error which stopped the restore, such as a broken session.
+	aborted error
+}
+
+type namedEntry struct {
+	name string
+	f    *RemoteFile
+}
+
+// Restores the contents of remote directory id into the local directory,
+// recreating the whole tree below it. Entries which fail are counted and the
+// restore goes on, unless the session can not be used anymore.
+func (b *BoxBackup) Restore(id int64, local string, opts *RestoreOptions) error {
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	if err := os.MkdirAll(local, 0o700); err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
+	r := &restorer{
+		b:    b,
+		opts: opts,
+	}
+	r.restoreDir(id, local)
+	if r.aborted != nil {
+		return fmt.Errorf("restore: %w", r.aborted)
+	}
+	if r.failed > 0 {
+		return fmt.Errorf("restore: %v entries failed", r.failed)
+	}
+	return nil
+}
+
+// Restores a single file, symlink, FIFO or device node from directory dir into
+// local path. When local is an existing directory, the file is restored into
+// it.
+func (b *BoxBackup) RestoreFile(dir int64, f *RemoteFile, local string) error {
+	if fi, err := os.Stat(local); err == nil && fi.IsDir() {
+		if !validName(f.Name()) {
+			return fmt.Errorf("restore: invalid name %q", f.Name())
+		}
+		local = filepath.Join(local, f.Name())
+	}
+	r := &restorer{
+		b:    b,
+		opts: &RestoreOptions{},
+	}
+	switch m := f.Mode(); {
+	case m&os.ModeSymlink != 0:
+		return r.restoreSymlink(local, f)
+	case m&(os.ModeNamedPipe|os.ModeDevice) != 0:
+		return r.restoreNode(local, f)
+	}
+	return r.restoreFile(dir, local, f)
+}
+
+func (r *restorer) selectEntries(de []*RemoteFile) []namedEntry {
+	return selectEntries(de, r.opts.IncludeDeleted, r.opts.IncludeOld, r.opts.AsOf)
+}
+
+// Picks the visible entries of a directory listing and unique names for them.
+// Deleted entries are included if there is no current one with the same name,
+// old versions get named name.0x<id>. When asOf is set, the listing is shown
+// as it looked at that time, see AsOf.
+func selectEntries(de []*RemoteFile, deleted, old bool, asOf time.Time) []namedEntry {
+	if !asOf.IsZero() {
+		var sel []namedEntry
+		for _, e := range AsOf(de, asOf) {
+			if validName(e.Name()) {
+				sel = append(sel, namedEntry{e.Name(), e})
+			}
+		}
+		return sel
+	}
+
+	current := make(map[string]bool)
+	for _, e := range de {
+		if e.Flags&(proto.Flags_Deleted|proto.Flags_OldVersion) == 0 {
+			current[e.Name()] = true
+		}
+	}
+
+	var sel []namedEntry
+	for _, e := range de {
+		n := e.Name()
+		if !validName(n) {
+			continue
+		}
+		isDeleted := e.Flags&proto.Flags_Deleted != 0
+		if isDeleted && !deleted {
+			continue
+		}
+		if e.Flags&proto.Flags_OldVersion != 0 {
+			if old && !e.IsDir() {
+				sel = append(sel, namedEntry{fmt.Sprintf("%s.0x%x", n, e.Id), e})
+			}
+			continue
+		}
+		if isDeleted && current[n] {
+			continue
+		}
+		current[n] = true
+		sel = append(sel, namedEntry{n, e})
+	}
+	return sel
+}
+
+// Checks that the name does not escape the local directory.
+func validName(n string) bool {
+	if n == "" || n == "." || n == ".." ||
+		strings.ContainsRune(n, '/') || strings.ContainsRune(n, filepath.Separator) {
+		glg.Warnf("Skipping invalid name: %q", n)
+		return false
+	}
+	return true
+}
+
+func (r *restorer) fail(p string, err error) {
+	glg.Errorf("Unable to restore %s: %s", p, err)
+	r.failed++
+	if r.aborted == nil && sessionError(err) {
+		r.aborted = err
+	}
+}
+
+func (r *restorer) restoreDir(id int64, local string) {
+	de, err := r.b.ReadDir(id)
+	if err != nil {
+		r.fail(fmt.Sprintf("directory %x", id), err)
+		return
+	}
+
+	for _, s := range r.selectEntries(de) {
+		if r.aborted != nil {
+			return
+		}
+		p := filepath.Join(local, s.name)
+		e := s.f
+
+		switch m := e.Mode(); {
+		case m.IsDir():
+			if err = makeDir(p); err != nil {
+				break
+			}
+			r.restoreDir(e.Id, p)
+			err = r.applyAttributes(p, e)
+		case m&os.ModeSymlink != 0:
+			err = r.restoreSymlink(p, e)
+		case m&os.ModeDevice != 0 && os.Geteuid() != 0:
+			glg.Warnf("Skipping device %s, restoring it needs root", p)
+			continue
+		case m&(os.ModeNamedPipe|os.ModeDevice) != 0:
+			err = r.restoreNode(p, e)
+		case m.IsRegular():
+			err = r.restoreFile(id, p, e)
+		default:
+			glg.Warnf("Skipping special file %s (%v)", p, m)
+			continue
+		}
+
+		if err != nil {
+			r.fail(p, err)
+			continue
+		}
+		if r.opts.Progress != nil {
+			r.opts.Progress(p, e)
+		}
+	}
+}
+
+func (r *restorer) restoreFile(dir int64, p string, e *RemoteFile) error {
+	if r.opts.Resume && r.restored(p, e) {
+		glg.Debugf("Skipping existing file %s", p)
+		return nil
+	}
+
+	rf, err := r.b.OpenFile(dir, e.Id)
+	if err != nil {
+		return err
+	}
+	// Closing drains the rest of the stream, so it has to happen in all cases.
+	defer rf.Close()
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, rf); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return r.applyAttributes(p, e)
+}
+
+// Returns whether the local file has the modification time and size of the
+// stored one. Only the block index is fetched for the size.
+func (r *restorer) restored(p string, e *RemoteFile) bool {
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() || fi.ModTime().Unix() != e.ModificationTime.Unix() {
+		return false
+	}
+	idx, err := r.b.blockIndexByID(context.Background(), e.Id)
+	if err != nil {
+		glg.Warnf("Unable to get block index of %s: %s", p, err)
+		return false
+	}
+	return idx.dataSize() == fi.Size()
+}
+
+// Creates a directory, replacing a local file or symlink of the same name so
+// that the restore does not write through it.
+func makeDir(p string) error {
+	fi, err := os.Lstat(p)
+	if err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		glg.Warnf("Replacing %s (%v) with a directory", p, fi.Mode().Type())
+		if err = os.Remove(p); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Mkdir(p, 0o700)
+}
+
+func (r *restorer) restoreSymlink(p string, e *RemoteFile) error {
+	if t, err := os.Readlink(p); err == nil {
+		if t == e.Symlink {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink(e.Symlink, p); err != nil {
+		return err
+	}
+	return r.applyAttributes(p, e)
+}
+
+// Creates a FIFO or device node, replacing an existing local file of another
+// type. Device nodes can only be created by root.
+func (r *restorer) restoreNode(p string, e *RemoteFile) error {
+	fi, err := os.Lstat(p)
+	if err == nil && (fi.Mode().Type() != e.Mode().Type() || fileDevice(fi) != e.Device) {
+		if err = os.Remove(p); err != nil {
+			return err
+		}
+		err = os.ErrNotExist
+	}
+	if os.IsNotExist(err) {
+		if err = makeNode(p, e); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return r.applyAttributes(p, e)
+}
+
+// Sets ownership, extended attributes, permissions and modification time from
+// the decoded attributes. Ownership is only changed when running as root.
+func (r *restorer) applyAttributes(p string, e *RemoteFile) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(p, int(e.UID), int(e.GID)); err != nil {
+			return err
+		}
+	}
+	if err := writeXattrs(p, e.Xattrs); err != nil {
+		return err
+	}
+	if e.mode&os.ModeSymlink != 0 {
+		// Permissions and times would be applied to the link target.
+		return nil
+	}
+	if err := os.Chmod(p, e.mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(p, e.ModificationTime, e.ModificationTime)
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestRestoreSelectEntries(t *testing.T) {
+	de := []*RemoteFile{
+		{name: "a", Id: 1, Flags: proto.Flags_File | proto.Flags_OldVersion},
+		{name: "a", Id: 2, Flags: proto.Flags_File},
+		{name: "b", Id: 3, Flags: proto.Flags_File | proto.Flags_Deleted},
+		{name: "c", Id: 4, Flags: proto.Flags_Dir},
+		{name: "..", Id: 5, Flags: proto.Flags_File},
+	}
+
+	for _, tc := range []struct {
+		opts RestoreOptions
+		want []string
+	}{
+		{RestoreOptions{}, []string{"a", "c"}},
+		{RestoreOptions{IncludeDeleted: true}, []string{"a", "b", "c"}},
+		{RestoreOptions{IncludeOld: true}, []string{"a.0x1", "a", "c"}},
+	} {
+		r := &restorer{opts: &tc.opts}
+		var got []string
+		for _, s := range r.selectEntries(de) {
+			got = append(got, s.name)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%+v: got %v, want %v", tc.opts, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%+v: got %v, want %v", tc.opts, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRestoreXattrs(t *testing.T) {
+	local := t.TempDir()
+	if err := writeXattrs(local, map[string][]byte{"user.test": {1}}); err != nil {
+		t.Skipf("No xattr support: %s", err)
+	}
+
+	bb, ts := newTestStore(t)
+	want := map[string][]byte{
+		"user.a": []byte("value"),
+		"user.b": {0, 1, 2},
+	}
+	f := ts.addFile(1, 2, "f", []byte("data"))
+	f.Xattrs = want
+
+	// Attributes from the listing.
+	de, err := bb.ReadDir(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(de[0].Xattrs, want) {
+		t.Errorf("Listed xattrs %q, want %q", de[0].Xattrs, want)
+	}
+
+	if err := bb.Restore(1, local, nil); err != nil {
+		t.Fatalf("Restore: %s", err)
+	}
+	p := filepath.Join(local, "f")
+	got, err := readXattrs(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Restored xattrs %q, want %q", got, want)
+	}
+	if h, _ := bb.LocalAttributesHash(p); h != bb.attributesHash(de[0]) {
+		t.Errorf("Restored file has a different attribute hash")
+	}
+}
+
+func TestRestoreSpecial(t *testing.T) {
+	bb, ts := newTestStore(t)
+	l := ts.add(1, 2, "link", proto.Flags_File, os.ModeSymlink|0o777)
+	l.Symlink = "target"
+	l.Xattrs = map[string][]byte{"trusted.x": {1}}
+	ts.add(1, 3, "fifo", proto.Flags_File, os.ModeNamedPipe|0o640)
+	d := ts.add(1, 4, "null", proto.Flags_File, os.ModeDevice|os.ModeCharDevice|0o666)
+	d.Device = 0x103
+
+	de, err := bb.ReadDir(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if de[0].Symlink != "target" || !reflect.DeepEqual(de[0].Xattrs, l.Xattrs) {
+		t.Errorf("Listed symlink %q with xattrs %q", de[0].Symlink, de[0].Xattrs)
+	}
+	for i, e := range ts.dirs[1] {
+		if de[i].Mode() != e.mode || de[i].Device != e.Device {
+			t.Errorf("Listed %s as %v device %x, want %v device %x",
+				e.name, de[i].Mode(), de[i].Device, e.mode, e.Device)
+		}
+	}
+
+	local := t.TempDir()
+	r := &restorer{b: bb, opts: &RestoreOptions{}}
+	if err := r.restoreSymlink(filepath.Join(local, "link"), de[0]); err != nil {
+		// Setting trusted.* xattrs needs privileges.
+		if !errors.Is(err, syscall.EPERM) {
+			t.Errorf("Restoring symlink: %s", err)
+		}
+	}
+	if got, err := os.Readlink(filepath.Join(local, "link")); err != nil || got != "target" {
+		t.Errorf("Restored symlink to %q: %v", got, err)
+	}
+	for _, e := range de[1:] {
+		p := filepath.Join(local, e.Name())
+		if err := r.restoreNode(p, e); err != nil {
+			t.Logf("Unable to restore %s: %s", e.Name(), err)
+			continue
+		}
+		fi, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != e.Mode() || fileDevice(fi) != e.Device {
+			t.Errorf("Restored %s as %v device %x, want %v device %x",
+				e.Name(), fi.Mode(), fileDevice(fi), e.Mode(), e.Device)
+		}
+	}
+}
+
+func TestRestoreResume(t *testing.T) {
+	bb, ts := newTestStore(t)
+	ts.addDir(1, 2, "sub")
+	ts.addFile(2, 3, "a", []byte("remote a"))
+	b := ts.addFile(1, 4, "b", []byte("remote b"))
+
+	local := t.TempDir()
+	// A local file where the remote directory goes is replaced.
+	if err := ioutil.WriteFile(filepath.Join(local, "sub"), []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := bb.Restore(1, local, &RestoreOptions{Resume: true}); err != nil {
+		t.Fatalf("Restore: %s", err)
+	}
+	if d, err := ioutil.ReadFile(filepath.Join(local, "sub", "a")); err != nil || string(d) != "remote a" {
+		t.Errorf("Restored sub/a as %q: %v", d, err)
+	}
+
+	// Files with the same time and size are skipped, others restored again.
+	p := filepath.Join(local, "b")
+	for _, c := range []struct {
+		local, want string
+	}{
+		{"change b", "change b"},
+		{"short", "remote b"},
+	} {
+		if err := ioutil.WriteFile(p, []byte(c.local), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, b.ModificationTime, b.ModificationTime)
+		if err := bb.Restore(1, local, &RestoreOptions{Resume: true}); err != nil {
+			t.Fatalf("Restore: %s", err)
+		}
+		if d, _ := ioutil.ReadFile(p); string(d) != c.want {
+			t.Errorf("Resuming over %q restored %q, want %q", c.local, d, c.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns owner of the local file.
+func fileOwner(fi os.FileInfo) (uint32, uint32) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid
+	}
+	return 0, 0
+}
+
+// Returns device number of a local device node.
+func fileDevice(fi os.FileInfo) uint32 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode()&os.ModeDevice != 0 {
+		return uint32(st.Rdev)
+	}
+	return 0
+}
+
+// Creates a FIFO or device node described by the entry.
+func makeNode(p string, e *RemoteFile) error {
+	m := uint32(writeMode(e.mode))
+	if err := syscall.Mknod(p, m, int(e.Device)); err != nil {
+		return &os.PathError{Op: "mknod", Path: p, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package client
+
+import (
+	"errors"
+	"os"
+)
+
+// Windows files have no numeric owners.
+func fileOwner(fi os.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
+
+// Windows has no device nodes.
+func fileDevice(fi os.FileInfo) uint32 {
+	return 0
+}
+
+func makeNode(p string, e *RemoteFile) error {
+	return errors.New("special files are not supported")
+}
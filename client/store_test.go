@@ -0,0 +1,461 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-memory store served over a pipe. Files are kept as plain data and
+// encoded in 1k blocks when they are read.
+type testStore struct {
+	mu    sync.Mutex
+	t     *testing.T
+	bb    *BoxBackup
+	dirs  map[int64][]*RemoteFile
+	data  map[int64][]byte
+	names map[int64]*RemoteFile
+	// Encoded attributes of the directories, with their size.
+	dirAttrs map[int64][]byte
+	// Number of uploads, and whether they are refused as if the account was
+	// full.
+	uploads int
+	full    bool
+	// Block indexes of the uploaded files, as sent.
+	uploaded map[int64]*blockIndex
+	// Number of listing, file and block index requests.
+	lists   int
+	files   int
+	indexes int
+	// Number of keepalive messages.
+	alive int
+	// Changes the encoded file before it is sent.
+	mangle func(id int64, bi *blockIndex, data []byte)
+}
+
+// Returns a client session talking to an empty store with the root directory.
+func newTestStore(t *testing.T) (*BoxBackup, *testStore) {
+	bb, s := newTestSession(t)
+	ts := &testStore{
+		t:     t,
+		bb:    bb,
+		dirs:  map[int64][]*RemoteFile{1: nil},
+		data:  make(map[int64][]byte),
+		names: make(map[int64]*RemoteFile),
+
+		dirAttrs: make(map[int64][]byte),
+		uploaded: make(map[int64]*blockIndex),
+	}
+	go ts.serve(s)
+	return bb, ts
+}
+
+// Returns another session to the same store.
+func (ts *testStore) session() *BoxBackup {
+	s, c := net.Pipe()
+	bb := NewBoxBackup(c, ts.bb.crypt)
+	bb.ready = true
+	ts.t.Cleanup(func() {
+		s.Close()
+		c.Close()
+	})
+	go ts.serve(s)
+	return bb
+}
+
+func (ts *testStore) add(parent, id int64, name string, flags int16, mode os.FileMode) *RemoteFile {
+	e := &RemoteFile{
+		name:             name,
+		Id:               id,
+		ParentId:         parent,
+		Flags:            flags,
+		mode:             mode,
+		UID:              1000,
+		GID:              100,
+		ModificationTime: time.Unix(1600000000+id, 0),
+	}
+	ts.dirs[parent] = append(ts.dirs[parent], e)
+	ts.names[id] = e
+	return e
+}
+
+func (ts *testStore) addDir(parent, id int64, name string) *RemoteFile {
+	ts.dirs[id] = nil
+	return ts.add(parent, id, name, proto.Flags_Dir, os.ModeDir|0o755)
+}
+
+func (ts *testStore) addFile(parent, id int64, name string, data []byte) *RemoteFile {
+	ts.data[id] = data
+	e := ts.add(parent, id, name, proto.Flags_File, 0o644)
+	e.size = int64(len(data)+1023) / 1024
+	return e
+}
+
+// Splits data into 1k blocks and encodes them.
+func (ts *testStore) encodeBlocks(data []byte) (*blockIndex, []byte) {
+	bi := &blockIndex{
+		Index: proto.FileBlockIndex{
+			MagicValue: 0x62696478,
+		},
+	}
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(data); i += 1024 {
+		e := i + 1024
+		if e > len(data) {
+			e = len(data)
+		}
+		blk := newDiffBlock(data[i:e])
+		ct, _ := ts.bb.crypt.EncryptFileData(blk.data, make([]byte, 16))
+		buf.WriteByte(proto.BlockEncodingAES << 1)
+		buf.Write(ct)
+		bi.Sizes = append(bi.Sizes, int64(len(ct)+1))
+		bi.Blocks = append(bi.Blocks, blk.entry)
+	}
+	bi.Index.NumBlocks = int64(len(bi.Blocks))
+	return bi, buf.Bytes()
+}
+
+func (ts *testStore) dirStream(id int64) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, &proto.DirStream{
+		MagicValue: 0x4449525F,
+		NumEntries: int32(len(ts.dirs[id])),
+		ObjectID:   id,
+	})
+	if a, ok := ts.dirAttrs[id]; ok {
+		buf.Write(a)
+	} else {
+		binary.Write(buf, binary.BigEndian, int32(0))
+	}
+	for _, e := range ts.dirs[id] {
+		binary.Write(buf, binary.BigEndian, &proto.EntryStream{
+			ModificationTime: uint64(e.ModificationTime.Unix() * 1e6),
+			ObjectID:         e.Id,
+			SizeInBlocks:     e.size,
+			AttributesHash:   e.AttributesHash,
+			Flags:            e.Flags,
+		})
+		ef, _ := ts.bb.writeFilename(e.name)
+		buf.Write(ef)
+		ts.bb.writeAttributes(buf, e)
+	}
+	return buf.Bytes()
+}
+
+// Encodes file in stream order, with the block index first.
+func (ts *testStore) fileStream(id int64) []byte {
+	e := ts.names[id]
+	bi, data := ts.encodeBlocks(ts.data[id])
+	if ts.mangle != nil {
+		ts.mangle(id, bi, data)
+	}
+	buf := new(bytes.Buffer)
+	ts.bb.writeBlockIndex(buf, bi)
+	binary.Write(buf, binary.BigEndian, &proto.FileStreamFormat{
+		MagicValue:       0x66696C65,
+		NumBlocks:        bi.Index.NumBlocks,
+		ContainerID:      e.ParentId,
+		ModificationTime: e.ModificationTime.Unix() * 1e6,
+	})
+	ef, _ := ts.bb.writeFilename(e.name)
+	buf.Write(ef)
+	ts.bb.writeAttributes(buf, e)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// Returns the names of object id and its parents, starting with the object.
+func (ts *testStore) objectName(d, id int64) (proto.ObjectName, []byte) {
+	if id == 0 {
+		id = d
+	} else if e, ok := ts.names[id]; !ok || e.ParentId != d {
+		return proto.ObjectName{}, nil
+	}
+	buf := new(bytes.Buffer)
+	n := int32(0)
+	for e, ok := ts.names[id]; ok; e, ok = ts.names[e.ParentId] {
+		ef, _ := ts.bb.writeFilename(e.name)
+		buf.Write(ef)
+		n++
+	}
+	if n == 0 {
+		return proto.ObjectName{}, nil
+	}
+	return proto.ObjectName{NumNameElements: n}, buf.Bytes()
+}
+
+func (ts *testStore) reply(s net.Conn, op interface{}, stream []byte) {
+	sendCommand(s, &Operation{Op: op})
+	if stream != nil {
+		binary.Write(s, binary.BigEndian, &proto.Header{
+			Size:    uint32(len(stream)),
+			Command: proto.STREAM_TYPE,
+		})
+		s.Write(stream)
+	}
+}
+
+func (ts *testStore) serve(s net.Conn) {
+	for {
+		var hdr proto.Header
+		if err := binary.Read(s, binary.BigEndian, &hdr); err != nil {
+			return
+		}
+		op, _ := proto.GetCommand(hdr.Command)
+		buf := make([]byte, hdr.Size-uint32(binary.Size(hdr)))
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return
+		}
+		var tail []byte
+		if op != nil {
+			binary.Read(bytes.NewReader(buf), binary.BigEndian, op)
+			tail = buf[binary.Size(op):]
+		}
+
+		ts.mu.Lock()
+		ts.handle(s, op, tail)
+		ts.mu.Unlock()
+	}
+}
+
+// Answers a single command, with tail holding the data after its fields.
+// Sessions of the same store are served one command at a time.
+func (ts *testStore) handle(s net.Conn, op interface{}, tail []byte) {
+	switch o := op.(type) {
+	case *proto.ListDirectory:
+		ts.lists++
+		if _, ok := ts.dirs[o.ObjectID]; !ok {
+			ts.reply(s, proto.Error{Type: 1000, SubType: 7}, nil)
+			return
+		}
+		ts.reply(s, proto.Success{ObjectID: o.ObjectID}, ts.dirStream(o.ObjectID))
+	case *proto.GetFile:
+		ts.files++
+		if _, ok := ts.data[o.ObjectID]; !ok {
+			ts.reply(s, proto.Error{Type: 1000, SubType: 7}, nil)
+			return
+		}
+		ts.reply(s, proto.Success{ObjectID: o.ObjectID}, ts.fileStream(o.ObjectID))
+	case *proto.GetBlockIndexByID:
+		ts.indexes++
+		if _, ok := ts.data[o.ObjectID]; !ok {
+			ts.reply(s, proto.Error{Type: 1000, SubType: 7}, nil)
+			return
+		}
+		bi, _ := ts.encodeBlocks(ts.data[o.ObjectID])
+		idx := new(bytes.Buffer)
+		ts.bb.writeBlockIndex(idx, bi)
+		ts.reply(s, proto.Success{ObjectID: o.ObjectID}, idx.Bytes())
+	case *proto.GetObjectName:
+		on, names := ts.objectName(o.ContainingDirectoryID, o.ObjectID)
+		ts.reply(s, on, names)
+	case *proto.GetBlockIndexByName:
+		e := ts.current(o.InDirectory, ts.filename(tail))
+		if e == nil || e.IsDir() {
+			ts.reply(s, proto.Success{}, nil)
+			return
+		}
+		bi, _ := ts.encodeBlocks(ts.data[e.Id])
+		idx := new(bytes.Buffer)
+		ts.bb.writeBlockIndex(idx, bi)
+		ts.reply(s, proto.Success{ObjectID: e.Id}, idx.Bytes())
+	case *proto.StoreFile:
+		up := ts.recvStream(s)
+		ts.uploads++
+		if ts.full {
+			ts.reply(s, proto.Error{Type: 1000, SubType: 11}, nil)
+			return
+		}
+		id, err := ts.storeFile(o, up)
+		if err != nil {
+			ts.t.Errorf("Storing file: %s", err)
+			ts.reply(s, proto.Error{Type: 1000, SubType: 6}, nil)
+			return
+		}
+		ts.reply(s, proto.Success{ObjectID: id}, nil)
+	case *proto.DeleteFile:
+		e := ts.current(o.InDirectory, ts.filename(tail))
+		if e == nil || e.IsDir() {
+			ts.reply(s, proto.Success{}, nil)
+			return
+		}
+		e.Flags |= proto.Flags_Deleted
+		ts.reply(s, proto.Success{ObjectID: e.Id}, nil)
+	case *proto.CreateDirectory, *proto.CreateDirectory2:
+		var parent int64
+		if c, ok := o.(*proto.CreateDirectory); ok {
+			parent = c.ContainingDirectoryID
+		} else {
+			parent = o.(*proto.CreateDirectory2).ContainingDirectoryID
+		}
+		a := ts.recvStream(s)
+		if _, ok := ts.dirs[parent]; !ok {
+			ts.reply(s, proto.Error{Type: 1000, SubType: 7}, nil)
+			return
+		}
+		id := ts.newID()
+		e := ts.addDir(parent, id, ts.filename(tail))
+		ts.bb.readAttributes(bufferedStream(a), e)
+		ts.dirAttrs[id] = a
+		ts.reply(s, proto.Success{ObjectID: id}, nil)
+	case *proto.DeleteDirectory:
+		e, ok := ts.names[o.ObjectID]
+		if !ok || !e.IsDir() {
+			ts.reply(s, proto.Error{Type: 1000, SubType: 7}, nil)
+			return
+		}
+		e.Flags |= proto.Flags_Deleted
+		ts.reply(s, proto.Success{ObjectID: e.Id}, nil)
+	case *proto.ChangeDirAttributes:
+		a := ts.recvStream(s)
+		if _, ok := ts.dirs[o.ObjectID]; !ok {
+			ts.reply(s, proto.Error{Type: 1000, SubType: 7}, nil)
+			return
+		}
+		ts.dirAttrs[o.ObjectID] = a
+		ts.reply(s, proto.Success{ObjectID: o.ObjectID}, nil)
+	case *proto.GetAccountUsage2:
+		ts.reply(s, proto.AccountUsage2{
+			AccountName: "test",
+			AccountUsage2Info: proto.AccountUsage2Info{
+				AccountEnabled: true,
+				BlockSize:      1024,
+			},
+		}, nil)
+	case *proto.GetIsAlive:
+		ts.alive++
+		ts.reply(s, proto.IsAlive{}, nil)
+	case *proto.Finished:
+		ts.reply(s, proto.Finished{}, nil)
+	default:
+		ts.t.Errorf("Unexpected command: %T", op)
+		ts.reply(s, proto.Error{Type: 1000, SubType: 2}, nil)
+	}
+}
+
+// Returns a stream over data received from the client.
+func bufferedStream(d []byte) *Stream {
+	return &Stream{
+		size:   uint32(len(d)),
+		reader: bufio.NewReader(bytes.NewReader(d)),
+	}
+}
+
+// Reads the stream following a command.
+func (ts *testStore) recvStream(s net.Conn) []byte {
+	var hdr proto.Header
+	binary.Read(s, binary.BigEndian, &hdr)
+	if hdr.Command != proto.STREAM_TYPE {
+		ts.t.Errorf("Expected stream, got: %+v", hdr)
+	}
+	d := make([]byte, hdr.Size)
+	io.ReadFull(s, d)
+	return d
+}
+
+// Decodes the file name sent after the fields of a command.
+func (ts *testStore) filename(tail []byte) string {
+	n, err := ts.bb.readFilenameStream(bufferedStream(tail))
+	if err != nil {
+		ts.t.Errorf("Decoding filename: %s", err)
+	}
+	return n
+}
+
+// Returns the entry with the name in directory d which is neither deleted nor
+// an old version.
+func (ts *testStore) current(d int64, name string) *RemoteFile {
+	for _, e := range ts.dirs[d] {
+		if e.name == name && e.Flags&(proto.Flags_Deleted|proto.Flags_OldVersion) == 0 {
+			return e
+		}
+	}
+	return nil
+}
+
+func (ts *testStore) newID() int64 {
+	id := int64(100)
+	for n := range ts.names {
+		if n >= id {
+			id = n + 1
+		}
+	}
+	return id
+}
+
+// Decodes an uploaded file in store format, taking the blocks a diff refers
+// to from the file it was made against, and adds it as the current version.
+func (ts *testStore) storeFile(o *proto.StoreFile, up []byte) (int64, error) {
+	if _, ok := ts.dirs[o.DirectoryObjectID]; !ok {
+		return 0, fmt.Errorf("no directory %x", o.DirectoryObjectID)
+	}
+	rd := bufferedStream(up)
+	var fs proto.FileStreamFormat
+	binary.Read(rd, binary.BigEndian, &fs)
+	if fs.MagicValue != proto.FileMagicV1 {
+		return 0, fmt.Errorf("file magic 0x%x", uint32(fs.MagicValue))
+	}
+	name, err := ts.bb.readFilenameStream(rd)
+	if err != nil {
+		return 0, err
+	}
+	attrs := &RemoteFile{}
+	if err := ts.bb.readAttributes(rd, attrs); err != nil {
+		return 0, err
+	}
+	isz := binary.Size(proto.FileBlockIndex{}) +
+		int(fs.NumBlocks)*(8+binary.Size(proto.FileBlockIndexEntry{}))
+	blocks := make([]byte, int(rd.Remaining())-isz)
+	if _, err := io.ReadFull(rd, blocks); err != nil {
+		return 0, err
+	}
+	bi := ts.bb.readBlockIndex(rd)
+
+	old, ok := ts.data[o.DiffFromFileID]
+	if o.DiffFromFileID != 0 && !ok {
+		return 0, fmt.Errorf("no file %x to diff from", o.DiffFromFileID)
+	}
+	var data []byte
+	for n, sz := range bi.Sizes {
+		if sz <= 0 {
+			if o.DiffFromFileID == 0 || -sz*1024 >= int64(len(old)) {
+				return 0, fmt.Errorf("block %v refers to missing block %v", n, -sz)
+			}
+			e := -sz*1024 + 1024
+			if e > int64(len(old)) {
+				e = int64(len(old))
+			}
+			data = append(data, old[-sz*1024:e]...)
+			continue
+		}
+		d, err := ts.bb.decodeBlock(blocks[:sz], &bi.Blocks[n])
+		if err != nil {
+			return 0, fmt.Errorf("block %v: %w", n, err)
+		}
+		data = append(data, d...)
+		blocks = blocks[sz:]
+	}
+
+	if e := ts.current(o.DirectoryObjectID, name); e != nil {
+		e.Flags |= proto.Flags_OldVersion
+	}
+	id := ts.newID()
+	e := ts.addFile(o.DirectoryObjectID, id, name, data)
+	e.mode = attrs.mode
+	e.UID, e.GID = attrs.UID, attrs.GID
+	e.Device = attrs.Device
+	e.Symlink = attrs.Symlink
+	e.Xattrs = attrs.Xattrs
+	e.ModificationTime = time.Unix(0, o.ModificationTime*1000)
+	e.AttributesHash = uint64(o.AttributesHash)
+	ts.uploaded[id] = bi
+	return id, nil
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"context"
+	"fmt"
+
+	"github.com/kpango/glg"
+)
+
+// AccountUsage is the space used by the account in the store. Sizes are in
+// bytes, converted from store blocks.
+type AccountUsage struct {
+	// Empty with servers which only know GetAccountUsage, as are the numbers
+	// of entries.
+	AccountName string `json:"account_name"`
+	Enabled     bool   `json:"enabled"`
+	BlockSize   int64  `json:"block_size"`
+
+	Used         int64 `json:"used"` // in total
+	CurrentFiles int64 `json:"current_files"`
+	OldFiles     int64 `json:"old_files"`
+	DeletedFiles int64 `json:"deleted_files"`
+	Directories  int64 `json:"directories"`
+	SoftLimit    int64 `json:"soft_limit"`
+	HardLimit    int64 `json:"hard_limit"`
+
+	NumCurrentFiles int64 `json:"num_current_files"`
+	NumOldFiles     int64 `json:"num_old_files"`
+	NumDeletedFiles int64 `json:"num_deleted_files"`
+	NumDirectories  int64 `json:"num_directories"`
+}
+
+// Returns the space used by the account. Servers without GetAccountUsage2 are
+// asked with GetAccountUsage.
+func (b *BoxBackup) GetAccountUsage() (*AccountUsage, error) {
+	return b.GetAccountUsageContext(context.Background())
+}
+
+// Context variant of GetAccountUsage.
+func (b *BoxBackup) GetAccountUsageContext(ctx context.Context) (*AccountUsage, error) {
+	p, err := b.ExecuteContext(ctx, &Operation{Op: proto.GetAccountUsage2{}})
+	if b.unknownCommand(ctx, err) {
+		glg.Warnf("server does not support GetAccountUsage2: %s", err)
+		p, err = b.ExecuteContext(ctx, &Operation{Op: proto.GetAccountUsage{}})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get account usage failed: %w", err)
+	}
+	glg.Logf("account usage: %+v", p)
+
+	switch u := p.(type) {
+	case *proto.AccountUsage2:
+		bs := int64(u.BlockSize)
+		return &AccountUsage{
+			AccountName:     u.AccountName,
+			Enabled:         u.AccountEnabled,
+			BlockSize:       bs,
+			Used:            u.BlocksUsed * bs,
+			CurrentFiles:    u.BlocksInCurrentFiles * bs,
+			OldFiles:        u.BlocksInOldFiles * bs,
+			DeletedFiles:    u.BlocksInDeletedFiles * bs,
+			Directories:     u.BlocksInDirectories * bs,
+			SoftLimit:       u.BlocksSoftLimit * bs,
+			HardLimit:       u.BlocksHardLimit * bs,
+			NumCurrentFiles: u.NumCurrentFiles,
+			NumOldFiles:     u.NumOldFiles,
+			NumDeletedFiles: u.NumDeletedFiles,
+			NumDirectories:  u.NumDirectories,
+		}, nil
+	case *proto.AccountUsage:
+		bs := int64(u.BlockSize)
+		cur := u.BlocksUsed - u.BlocksInOldFiles - u.BlocksInDeletedFiles - u.BlocksInDirectories
+		return &AccountUsage{
+			Enabled:      true,
+			BlockSize:    bs,
+			Used:         u.BlocksUsed * bs,
+			CurrentFiles: cur * bs,
+			OldFiles:     u.BlocksInOldFiles * bs,
+			DeletedFiles: u.BlocksInDeletedFiles * bs,
+			Directories:  u.BlocksInDirectories * bs,
+			SoftLimit:    u.BlocksSoftLimit * bs,
+			HardLimit:    u.BlocksHardLimit * bs,
+		}, nil
+	}
+	return nil, fmt.Errorf("get account usage: unexpected reply %T", p)
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestGetAccountUsage(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	go func() {
+		if _, ok := recvCommand(t, s, false).(*proto.GetAccountUsage2); !ok {
+			t.Errorf("Expected GetAccountUsage2")
+		}
+		sendCommand(s, &Operation{Op: proto.AccountUsage2{
+			AccountName: "backup-01",
+			AccountUsage2Info: proto.AccountUsage2Info{
+				AccountEnabled:       true,
+				BlockSize:            4096,
+				BlocksUsed:           100,
+				BlocksInCurrentFiles: 60,
+				BlocksInOldFiles:     20,
+				BlocksInDeletedFiles: 15,
+				BlocksInDirectories:  5,
+				BlocksSoftLimit:      1000,
+				BlocksHardLimit:      1200,
+				NumCurrentFiles:      7,
+				NumDirectories:       2,
+			},
+		}})
+	}()
+
+	u, err := bb.GetAccountUsage()
+	if err != nil {
+		t.Fatalf("GetAccountUsage: %s", err)
+	}
+	want := AccountUsage{
+		AccountName:     "backup-01",
+		Enabled:         true,
+		BlockSize:       4096,
+		Used:            100 * 4096,
+		CurrentFiles:    60 * 4096,
+		OldFiles:        20 * 4096,
+		DeletedFiles:    15 * 4096,
+		Directories:     5 * 4096,
+		SoftLimit:       1000 * 4096,
+		HardLimit:       1200 * 4096,
+		NumCurrentFiles: 7,
+		NumDirectories:  2,
+	}
+	if *u != want {
+		t.Errorf("Got %+v, want %+v", *u, want)
+	}
+}
+
+func TestGetAccountUsageFallback(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	go func() {
+		recvCommand(t, s, false)
+		sendCommand(s, &Operation{Op: proto.Error{Type: 0, SubType: 1}})
+		if _, ok := recvCommand(t, s, false).(*proto.GetAccountUsage); !ok {
+			t.Errorf("Expected GetAccountUsage")
+		}
+		sendCommand(s, &Operation{Op: proto.AccountUsage{
+			BlocksUsed:           100,
+			BlocksInOldFiles:     20,
+			BlocksInDeletedFiles: 15,
+			BlocksInDirectories:  5,
+			BlocksSoftLimit:      1000,
+			BlocksHardLimit:      1200,
+			BlockSize:            2048,
+		}})
+	}()
+
+	u, err := bb.GetAccountUsage()
+	if err != nil {
+		t.Fatalf("GetAccountUsage: %s", err)
+	}
+	if u.CurrentFiles != 60*2048 || u.Used != 100*2048 || u.HardLimit != 1200*2048 || !u.Enabled {
+		t.Errorf("Wrong usage from GetAccountUsage: %+v", *u)
+	}
+}
+
+func TestGetAccountUsageDropped(t *testing.T) {
+	bb, s := newTestSession(t)
+
+	go func() {
+		recvCommand(t, s, false)
+		s.Close()
+	}()
+	bb.SetDialer(func() (net.Conn, error) {
+		s, c := net.Pipe()
+		t.Cleanup(func() { s.Close() })
+		go func() {
+			hs := make([]byte, proto.HandshakeLen)
+			if _, err := io.ReadFull(s, hs); err != nil {
+				return
+			}
+			s.Write(hs)
+			if _, ok := recvCommand(t, s, false).(*proto.GetAccountUsage); !ok {
+				t.Errorf("Expected GetAccountUsage")
+			}
+			sendCommand(s, &Operation{Op: proto.AccountUsage{
+				BlocksUsed: 10,
+				BlockSize:  2048,
+			}})
+		}()
+		return c, nil
+	})
+
+	u, err := bb.GetAccountUsage()
+	if err != nil {
+		t.Fatalf("GetAccountUsage: %s", err)
+	}
+	if u.Used != 10*2048 {
+		t.Errorf("Expected %v bytes used, got %v", 10*2048, u.Used)
+	}
+}
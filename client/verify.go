@@ -0,0 +1,167 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// Kinds of problems found by Verify.
+const (
+	ProblemRead         = "read"          // file or directory can not be fetched
+	ProblemAttributes   = "attributes"    // name or attributes can not be decoded
+	ProblemForeign      = "foreign"       // block of the other file of a diff is missing
+	ProblemCorrupt      = "corrupt"       // block can not be decoded or fails MD5
+	ProblemEncoding     = "encoding"      // file or block format is not known
+	ProblemWeakChecksum = "weak-checksum" // block decodes, but the weak checksum differs
+	ProblemAborted      = "aborted"       // stream ended early, rest of the file unchecked
+)
+
+// VerifyOptions select the files checked by Verify.
+type VerifyOptions struct {
+	// Check files in subdirectories as well.
+	Recursive bool
+	// Check old versions of files, not only the current ones.
+	IncludeOld bool
+	// Called after each checked file with the problems found in it.
+	Progress func(path string, f *RemoteFile, problems []VerifyProblem)
+}
+
+// Problem found in a file or directory.
+type VerifyProblem struct {
+	Path  string `json:"path"`
+	Id    int64  `json:"id"`
+	Kind  string `json:"kind"`
+	Block int64  `json:"block"` // -1 when not about a single block
+	Error string `json:"error"`
+}
+
+// VerifyReport summarizes a Verify run.
+type VerifyReport struct {
+	Files    int64           `json:"files"`
+	Blocks   int64           `json:"blocks"`
+	Bytes    int64           `json:"bytes"`
+	Problems []VerifyProblem `json:"problems"`
+}
+
+func newVerifyReport() *VerifyReport {
+	return &VerifyReport{
+		Problems: []VerifyProblem{},
+	}
+}
+
+// Returns whether no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) add(p string, id int64, kind string, block int64, err error) {
+	r.Problems = append(r.Problems, VerifyProblem{
+		Path:  p,
+		Id:    id,
+		Kind:  kind,
+		Block: block,
+		Error: err.Error(),
+	})
+}
+
+// Fetches every file in directory dir and decodes all of its blocks, checking
+// them against the block index. Nothing is written locally. The returned
+// error is only set when dir itself can not be read, problems with the files
+// are listed in the report.
+func (b *BoxBackup) Verify(dir int64, opts *VerifyOptions) (*VerifyReport, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	wo := &WalkOptions{
+		FlagsNotToBeSet: proto.Flags_Deleted,
+	}
+	if !opts.IncludeOld {
+		wo.FlagsNotToBeSet |= proto.Flags_OldVersion
+	}
+
+	r := newVerifyReport()
+	err := b.Walk(dir, func(p string, e *RemoteFile, err error) error {
+		if err != nil {
+			if e == nil || e.Id == dir {
+				return err
+			}
+			r.add(p, e.Id, ProblemRead, -1, err)
+			return nil
+		}
+		if e.IsDir() {
+			if e.Id != dir && !opts.Recursive {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		n := len(r.Problems)
+		b.verifyFile(r, p, e.ParentId, e.Id)
+		if opts.Progress != nil {
+			opts.Progress(p, e, r.Problems[n:])
+		}
+		return nil
+	}, wo)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Checks a single file in directory dir, see Verify.
+func (b *BoxBackup) VerifyFile(dir int64, f *RemoteFile) *VerifyReport {
+	p, err := b.PathOf(f.Id)
+	if err != nil {
+		p = f.Name()
+	}
+	r := newVerifyReport()
+	b.verifyFile(r, p, dir, f.Id)
+	return r
+}
+
+func (b *BoxBackup) verifyFile(r *VerifyReport, p string, dir, id int64) {
+	r.Files++
+	f, err := b.OpenFile(dir, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrAttributes):
+			r.add(p, id, ProblemAttributes, -1, err)
+		case errors.Is(err, ErrCorrupt):
+			r.add(p, id, ProblemCorrupt, -1, err)
+		case errors.Is(err, ErrForeign):
+			r.add(p, id, ProblemForeign, -1, err)
+		case errors.Is(err, ErrUnknownEncoding):
+			r.add(p, id, ProblemEncoding, -1, err)
+		default:
+			r.add(p, id, ProblemRead, -1, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	for n := int64(0); n < f.idx.Index.NumBlocks; n++ {
+		r.Blocks++
+		blk := &f.idx.Blocks[n]
+		d, err := f.blockAt(n)
+		switch {
+		case errors.Is(err, ErrCorrupt):
+			r.add(p, id, ProblemCorrupt, n, err)
+			continue
+		case errors.Is(err, ErrForeign):
+			r.add(p, id, ProblemForeign, n, err)
+			continue
+		case errors.Is(err, ErrUnknownEncoding):
+			r.add(p, id, ProblemEncoding, n, err)
+			continue
+		case err != nil:
+			r.add(p, id, ProblemAborted, n, err)
+			return
+		}
+		r.Bytes += int64(len(d))
+		if w, ok := weakChecksumMatches(d, blk); !ok {
+			r.add(p, id, ProblemWeakChecksum, n,
+				fmt.Errorf("0x%x != 0x%x", w, blk.WeakChecksum))
+		}
+	}
+}
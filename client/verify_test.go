@@ -0,0 +1,58 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	bb, ts := newTestStore(t)
+	data := bytes.Repeat([]byte("0123456789"), 250)
+	ts.addFile(1, 2, "good", data)
+	ts.addFile(1, 3, "corrupt", data)
+	ts.addFile(1, 4, "weak", data)
+	ts.addDir(1, 5, "sub")
+	ts.addFile(5, 6, "deep", data)
+	ts.mangle = func(id int64, bi *blockIndex, data []byte) {
+		switch id {
+		case 3:
+			// Second block, past its header byte.
+			data[bi.Sizes[0]+5] ^= 0xff
+		case 4:
+			bi.Blocks[2].WeakChecksum ^= 0xffff
+		}
+	}
+
+	r, err := bb.Verify(1, nil)
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if r.Files != 3 || r.Blocks != 9 {
+		t.Errorf("Checked %v files, %v blocks", r.Files, r.Blocks)
+	}
+	want := map[string]int64{"corrupt": 1, "weak-checksum": 2}
+	if len(r.Problems) != len(want) {
+		t.Errorf("Problems: %+v", r.Problems)
+	}
+	for _, p := range r.Problems {
+		if b, ok := want[p.Kind]; !ok || p.Block != b {
+			t.Errorf("Unexpected problem: %+v", p)
+		}
+	}
+
+	// The session has to stay usable after a corrupt file.
+	if r, err = bb.Verify(1, &VerifyOptions{Recursive: true}); err != nil {
+		t.Fatalf("Recursive verify: %s", err)
+	}
+	if r.Files != 4 || r.OK() {
+		t.Errorf("Recursive verify checked %v files, problems: %+v", r.Files, r.Problems)
+	}
+
+	e, err := bb.Resolve("/good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := bb.VerifyFile(1, e); !r.OK() || r.Bytes != int64(len(data)) {
+		t.Errorf("VerifyFile: %+v", r)
+	}
+}
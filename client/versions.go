@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"sort"
+	"time"
+)
+
+// Returns the directory listing as it looked at time t.
+//
+// Each file name resolves to the newest version modified at or before t, even
+// if it was deleted or replaced afterwards. The store does not record when an
+// entry was deleted, so a file deleted before t is still shown. Directories
+// are always included, preferring the current one over deleted ones with the
+// same name, as their modification time changes with their contents.
+func AsOf(de []*RemoteFile, t time.Time) []*RemoteFile {
+	pick := make(map[string]*RemoteFile)
+	for _, e := range de {
+		n := e.Name()
+		p, ok := pick[n]
+		if e.IsDir() {
+			if !ok || !p.IsDir() ||
+				(p.Flags&proto.Flags_Deleted != 0 && e.Flags&proto.Flags_Deleted == 0) {
+				pick[n] = e
+			}
+			continue
+		}
+		if e.ModificationTime.After(t) || (ok && p.IsDir()) {
+			continue
+		}
+		if !ok || e.ModificationTime.After(p.ModificationTime) ||
+			(e.ModificationTime.Equal(p.ModificationTime) && e.Id > p.Id) {
+			pick[n] = e
+		}
+	}
+
+	var r []*RemoteFile
+	for _, e := range de {
+		if pick[e.Name()] == e {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+// Returns all versions of file name in the directory listing, newest first.
+func Versions(de []*RemoteFile, name string) []*RemoteFile {
+	var v []*RemoteFile
+	for _, e := range de {
+		if !e.IsDir() && e.Name() == name {
+			v = append(v, e)
+		}
+	}
+	sort.SliceStable(v, func(i, j int) bool {
+		if v[i].ModificationTime.Equal(v[j].ModificationTime) {
+			return v[i].Id > v[j].Id
+		}
+		return v[i].ModificationTime.After(v[j].ModificationTime)
+	})
+	return v
+}
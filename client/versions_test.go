@@ -0,0 +1,63 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"testing"
+	"time"
+)
+
+func TestAsOf(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2026, 9, d, 12, 0, 0, 0, time.UTC)
+	}
+	de := []*RemoteFile{
+		{name: "a", Id: 1, Flags: proto.Flags_File | proto.Flags_OldVersion, ModificationTime: day(1)},
+		{name: "a", Id: 2, Flags: proto.Flags_File | proto.Flags_OldVersion, ModificationTime: day(3)},
+		{name: "a", Id: 3, Flags: proto.Flags_File, ModificationTime: day(5)},
+		{name: "b", Id: 4, Flags: proto.Flags_File | proto.Flags_Deleted, ModificationTime: day(2)},
+		{name: "c", Id: 5, Flags: proto.Flags_File, ModificationTime: day(6)},
+		{name: "d", Id: 6, Flags: proto.Flags_Dir | proto.Flags_Deleted, ModificationTime: day(1)},
+		{name: "d", Id: 7, Flags: proto.Flags_Dir, ModificationTime: day(9)},
+	}
+
+	for _, tc := range []struct {
+		at   time.Time
+		want []int64
+	}{
+		{day(1), []int64{1, 7}},
+		{day(4), []int64{2, 4, 7}},
+		{day(9), []int64{3, 4, 5, 7}},
+	} {
+		var got []int64
+		for _, e := range AsOf(de, tc.at) {
+			got = append(got, e.Id)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.at, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%v: got %v, want %v", tc.at, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2026, 9, d, 12, 0, 0, 0, time.UTC)
+	}
+	de := []*RemoteFile{
+		{name: "a", Id: 1, Flags: proto.Flags_File | proto.Flags_OldVersion, ModificationTime: day(1)},
+		{name: "a", Id: 3, Flags: proto.Flags_File, ModificationTime: day(5)},
+		{name: "b", Id: 4, Flags: proto.Flags_File, ModificationTime: day(2)},
+		{name: "a", Id: 2, Flags: proto.Flags_File | proto.Flags_OldVersion, ModificationTime: day(3)},
+		{name: "a", Id: 5, Flags: proto.Flags_Dir, ModificationTime: day(7)},
+	}
+	v := Versions(de, "a")
+	if len(v) != 3 || v[0].Id != 3 || v[1].Id != 2 || v[2].Id != 1 {
+		t.Errorf("Unexpected versions: %+v", v)
+	}
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"io/fs"
+	"path"
+)
+
+// WalkFunc is called by Walk for each visited entry, with its absolute path in
+// the store. As with filepath.WalkDir, returning fs.SkipDir for a directory
+// skips its contents and for a file the rest of its directory. When a
+// directory can not be listed, the function is called a second time for it
+// with the error.
+type WalkFunc func(path string, e *RemoteFile, err error) error
+
+// WalkOptions select the visited entries, see proto.Flags_File and others.
+type WalkOptions struct {
+	// Report only entries which have all of these flags set.
+	FlagsMustBeSet int16
+	// Skip entries which have any of these flags set. Directories skipped
+	// this way are not descended into.
+	FlagsNotToBeSet int16
+	// Further sessions to the same store for listing directories in
+	// parallel, one directory per session at a time. The functions are
+	// still called from a single goroutine, but not in tree order.
+	Sessions []*BoxBackup
+}
+
+func (o *WalkOptions) matches(e *RemoteFile) bool {
+	return e.Flags&o.FlagsMustBeSet == o.FlagsMustBeSet && e.Flags&o.FlagsNotToBeSet == 0
+}
+
+func (o *WalkOptions) descend(e *RemoteFile) bool {
+	return e.IsDir() && e.Flags&o.FlagsNotToBeSet == 0
+}
+
+// Walks the tree below directory root, calling fn for each entry matching the
+// options, including root itself. Directories which do not match are still
+// walked into. Without extra sessions the entries are visited depth first, in
+// listing order. The session itself is left free for use by fn when walking in
+// parallel.
+func (b *BoxBackup) Walk(root int64, fn WalkFunc, opts *WalkOptions) error {
+	if opts == nil {
+		opts = &WalkOptions{}
+	}
+	p, err := b.PathOf(root)
+	if err != nil {
+		return fn("", nil, err)
+	}
+	e, err := b.ResolveFrom(root, ".")
+	if err != nil {
+		return fn(p, nil, err)
+	}
+
+	if opts.matches(e) {
+		if err := fn(p, e, nil); err != nil {
+			if err == fs.SkipDir {
+				return nil
+			}
+			return err
+		}
+	}
+	if len(opts.Sessions) > 0 {
+		err = b.walkParallel(p, e, fn, opts)
+	} else {
+		err = b.walkDir(p, e, fn, opts)
+	}
+	if err == fs.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// Calls fn for the entries of a listing and descend for the directories to
+// walk into.
+func walkEntries(p string, de []*RemoteFile, fn WalkFunc, opts *WalkOptions, descend func(string, *RemoteFile) error) error {
+	for _, e := range de {
+		if !opts.descend(e) && !opts.matches(e) {
+			continue
+		}
+		ep := path.Join(p, e.Name())
+		if opts.matches(e) {
+			if err := fn(ep, e, nil); err != nil {
+				if err == fs.SkipDir && e.IsDir() {
+					continue
+				}
+				return err
+			}
+		}
+		if opts.descend(e) {
+			if err := descend(ep, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *BoxBackup) walkDir(p string, d *RemoteFile, fn WalkFunc, opts *WalkOptions) error {
+	de, err := b.ReadDir(d.Id)
+	if err != nil {
+		return fn(p, d, err)
+	}
+	err = walkEntries(p, de, fn, opts, func(ep string, e *RemoteFile) error {
+		err := b.walkDir(ep, e, fn, opts)
+		if err == fs.SkipDir {
+			// Rest of that directory was skipped.
+			return nil
+		}
+		return err
+	})
+	return err
+}
+
+type walkJob struct {
+	path string
+	dir  *RemoteFile
+}
+
+type walkResult struct {
+	walkJob
+	entries []*RemoteFile
+	err     error
+}
+
+func (b *BoxBackup) walkParallel(p string, d *RemoteFile, fn WalkFunc, opts *WalkOptions) error {
+	jobs := make(chan walkJob)
+	results := make(chan walkResult)
+	for _, s := range opts.Sessions {
+		go func(s *BoxBackup) {
+			for j := range jobs {
+				de, err := s.ReadDir(j.dir.Id)
+				results <- walkResult{j, de, err}
+			}
+		}(s)
+	}
+
+	pending := []walkJob{{p, d}}
+	running := 0
+	var err error
+	for err == nil && (len(pending) > 0 || running > 0) {
+		var send chan walkJob
+		var next walkJob
+		if len(pending) > 0 {
+			send = jobs
+			next = pending[len(pending)-1]
+		}
+		select {
+		case send <- next:
+			pending = pending[:len(pending)-1]
+			running++
+		case r := <-results:
+			running--
+			if r.err != nil {
+				err = fn(r.path, r.dir, r.err)
+				break
+			}
+			err = walkEntries(r.path, r.entries, fn, opts, func(ep string, e *RemoteFile) error {
+				pending = append(pending, walkJob{ep, e})
+				return nil
+			})
+		}
+		if err == fs.SkipDir {
+			err = nil
+		}
+	}
+
+	close(jobs)
+	for ; running > 0; running-- {
+		<-results
+	}
+	return err
+}
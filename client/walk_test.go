@@ -0,0 +1,90 @@
+package client
+
+import (
+	"bbq/client/proto"
+	"io/fs"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newWalkStore(t *testing.T) (*BoxBackup, *testStore) {
+	bb, ts := newTestStore(t)
+	ts.addDir(1, 2, "a")
+	ts.addFile(2, 3, "f1", []byte("x"))
+	ts.addDir(2, 4, "skip")
+	ts.addFile(4, 5, "f2", []byte("x"))
+	ts.addDir(1, 6, "b")
+	ts.addFile(6, 7, "f3", []byte("x"))
+	ts.addFile(6, 8, "f3", []byte("x")).Flags |= proto.Flags_OldVersion
+	ts.addDir(6, 9, "gone").Flags |= proto.Flags_Deleted
+	ts.addFile(9, 10, "f4", []byte("x")).Flags |= proto.Flags_Deleted
+	return bb, ts
+}
+
+func walkPaths(t *testing.T, bb *BoxBackup, opts *WalkOptions) []string {
+	var r []string
+	err := bb.Walk(1, func(p string, e *RemoteFile, err error) error {
+		if err != nil {
+			t.Errorf("Walk %s: %s", p, err)
+			return err
+		}
+		if e.Name() == "skip" {
+			return fs.SkipDir
+		}
+		r = append(r, p)
+		return nil
+	}, opts)
+	if err != nil {
+		t.Errorf("Walk: %s", err)
+	}
+	return r
+}
+
+func TestWalk(t *testing.T) {
+	bb, _ := newWalkStore(t)
+
+	want := []string{"/", "/a", "/a/f1", "/b", "/b/f3", "/b/f3", "/b/gone", "/b/gone/f4"}
+	if r := walkPaths(t, bb, nil); !reflect.DeepEqual(r, want) {
+		t.Errorf("Walk = %v, want %v", r, want)
+	}
+
+	// Directories are not reported, so they can not be skipped either.
+	want = []string{"/a/f1", "/a/skip/f2", "/b/f3"}
+	r := walkPaths(t, bb, &WalkOptions{
+		FlagsMustBeSet:  proto.Flags_File,
+		FlagsNotToBeSet: proto.Flags_Deleted | proto.Flags_OldVersion,
+	})
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("Walk of current files = %v, want %v", r, want)
+	}
+}
+
+func TestWalkParallel(t *testing.T) {
+	bb, ts := newWalkStore(t)
+	opts := &WalkOptions{
+		Sessions: []*BoxBackup{ts.session(), ts.session()},
+	}
+	want := walkPaths(t, bb, nil)
+	r := walkPaths(t, bb, opts)
+	sort.Strings(want)
+	sort.Strings(r)
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("Parallel walk = %v, want %v", r, want)
+	}
+
+	// Stopping early must not leave the sessions hanging.
+	n := 0
+	err := bb.Walk(1, func(p string, e *RemoteFile, err error) error {
+		if n++; n == 3 {
+			return fs.ErrClosed
+		}
+		return nil
+	}, opts)
+	if err != fs.ErrClosed {
+		t.Errorf("Walk returned %v, want %v", err, fs.ErrClosed)
+	}
+	if r := walkPaths(t, bb, opts); len(r) != len(want) {
+		t.Errorf("Walk after stopping = %v", r)
+	}
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reads the extended attributes of a local file, without following symlinks.
+// Returns nil when the file system does not support them.
+func readXattrs(p string) (map[string][]byte, error) {
+	sz, err := unix.Llistxattr(p, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if sz == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, sz)
+	if sz, err = unix.Llistxattr(p, buf); err != nil {
+		return nil, err
+	}
+
+	x := make(map[string][]byte)
+	for _, n := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(n) == 0 {
+			continue
+		}
+		vs, err := unix.Lgetxattr(p, string(n), nil)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]byte, vs)
+		if vs, err = unix.Lgetxattr(p, string(n), v); err != nil {
+			return nil, err
+		}
+		x[string(n)] = v[:vs]
+	}
+	return x, nil
+}
+
+// Sets the extended attributes on a local file, without following symlinks.
+func writeXattrs(p string, x map[string][]byte) error {
+	for _, n := range xattrNames(x) {
+		if err := unix.Lsetxattr(p, n, x[n], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"github.com/kpango/glg"
+)
+
+// Extended attributes are only supported on Linux.
+func readXattrs(p string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(p string, x map[string][]byte) error {
+	if len(x) > 0 {
+		glg.Warnf("Not restoring extended attributes of %s", p)
+	}
+	return nil
+}
@@ -5,6 +5,8 @@ import (
 	"compress/zlib"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/md5"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -161,6 +163,19 @@ func (c *Crypto) DecryptBlockIndexEntry(be []byte, iv []byte) error {
 	return cryptBlowfish(false, be, c.keyBlockIndex, iv)
 }
 
+// Hashes attribute data with the attribute secret appended. BoxBackup takes
+// the first 64 bits of the MD5 digest in host order, which is little endian on
+// the machines it runs on. Like bbackupd, callers leave the modification times
+// out of the data, as they are stored next to the hash.
+func (c *Crypto) HashAttributes(data ...[]byte) uint64 {
+	h := md5.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	h.Write(c.secretAttributes)
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
 func cryptBlowfish(enc bool, ct, key, iv []byte) error {
 	ci, err := blowfish.NewCipher(key)
 	if err != nil {
@@ -196,6 +211,28 @@ func (c *Crypto) DecryptFileData(fd []byte) ([]byte, error) {
 	return pkcs7Unpad(ct, aes.BlockSize), nil
 }
 
+// Encrypts file data with Blowfish, as older BoxBackup versions did.
+func (c *Crypto) EncryptFileDataBF(fd, iv []byte) ([]byte, error) {
+	ct := pkcs7Pad(fd, blowfish.BlockSize)
+	if err := cryptBlowfish(true, ct, c.keyFileDataBF, iv); err != nil {
+		return nil, err
+	}
+	return append(iv, ct...), nil
+}
+
+// Decrypts file data encrypted with Blowfish, see EncryptFileDataBF.
+func (c *Crypto) DecryptFileDataBF(fd []byte) ([]byte, error) {
+	if len(fd) < blowfish.BlockSize {
+		return nil, fmt.Errorf("blowfish text shorter than the IV")
+	}
+	iv := fd[:blowfish.BlockSize]
+	ct := fd[blowfish.BlockSize:]
+	if err := cryptBlowfish(false, ct, c.keyFileDataBF, iv); err != nil {
+		return nil, err
+	}
+	return pkcs7Unpad(ct, blowfish.BlockSize), nil
+}
+
 func cryptAES(enc bool, ct, key, iv []byte) ([]byte, error) {
 	ci, err := aes.NewCipher(key)
 	if err != nil {
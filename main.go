@@ -2,12 +2,18 @@ package main
 
 import (
 	"bbq/client"
+	"bbq/client/proto"
 	"bbq/crypto"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
@@ -21,27 +27,82 @@ import (
 var flagConfigFile = flag.String("config", "/etc/boxbackup/bbackupd.conf", "Main configuration file.")
 var flagTlsHost = flag.String("tlshost", "", "Verify remote host certificate against this name.")
 var flagVerbose = flag.Bool("verbose", false, "Increase logging output.")
+var flagAsOf = flag.String("as-of", "", "Browse the store as it was at this date.")
+var flagKeepAlive = flag.Duration("keepalive", time.Minute, "Ping the store after being idle this long, 0 to disable.")
 
 var bb *client.BoxBackup
 
-var nameCache map[int64][]string
-var dirCache map[int64][]*client.RemoteFile
-var entCache map[int64]*client.RemoteFile
-var currentDir int64 = 1
+var currentDir int64 = client.RootDirectory
+
+// Exit status when running a single command: 1 if compare or verify found
+// differences, 2 if the command failed.
+var exitStatus int
+
+// Point in time to browse, zero for the current state.
+var asOf time.Time
+
+// Plain explanations of the store errors.
+var storeErrors = []struct {
+	err error
+	msg string
+}{
+	{client.ErrWrongVersion, "server uses a different protocol version"},
+	{client.ErrBadLogin, "login refused, check the certificate and account number"},
+	{client.ErrCannotLockStoreForWriting, "store is locked by another client, such as bbackupd"},
+	{client.ErrSessionReadOnly, "session is read-only"},
+	{client.ErrFileDoesNotVerify, "server rejected the uploaded file"},
+	{client.ErrDoesNotExist, "no such file or directory in the store"},
+	{client.ErrDirectoryAlreadyExists, "directory exists already"},
+	{client.ErrCannotDeleteRoot, "root directory can not be deleted"},
+	{client.ErrTargetNameExists, "an entry with this name exists already"},
+	{client.ErrStorageLimitExceeded, "account has run out of space"},
+	{client.ErrDiffFromFileDoesNotExist, "file the upload is based on is gone"},
+	{client.ErrDoesNotExistInDirectory, "no such entry in the directory"},
+	{client.ErrDisabledAccount, "account is disabled"},
+	{client.ErrSessionBroken, "connection to the store was lost"},
+}
+
+// Returns the message of err, with store errors explained in plain words.
+func explain(err error) string {
+	for _, e := range storeErrors {
+		if errors.Is(err, e.err) {
+			return e.msg
+		}
+	}
+	return err.Error()
+}
 
 func listDirectory(id int64) ([]*client.RemoteFile, error) {
-	if d, ok := dirCache[id]; ok {
-		return d, nil
+	return bb.ReadDirCached(id)
+}
+
+// Returns the directory listing as it looked at the selected point in time.
+func viewDirectory(id int64) ([]*client.RemoteFile, error) {
+	de, err := listDirectory(id)
+	if err != nil || asOf.IsZero() {
+		return de, err
 	}
-	d, err := bb.ReadDir(id)
-	if err != nil {
-		return nil, err
+	return client.AsOf(de, asOf), nil
+}
+
+// Parses a date with optional time in local timezone. Plain dates include the
+// whole day.
+func parseDate(s string) (time.Time, error) {
+	for _, l := range []string{
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05",
+		"2006-01-02T15:04",
+		"2006-01-02 15:04",
+	} {
+		if t, err := time.ParseInLocation(l, s, time.Local); err == nil {
+			return t, nil
+		}
 	}
-	dirCache[id] = d
-	for _, e := range d {
-		entCache[e.Id] = e
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q, expecting YYYY-MM-DD [HH:MM[:SS]]", s)
 	}
-	return d, nil
+	return t.Add(24*time.Hour - time.Second), nil
 }
 
 func getHexId(s string) int64 {
@@ -54,35 +115,379 @@ func getHexId(s string) int64 {
 	return 0
 }
 
+// Splits a path relative to the current directory into the ID of the directory
+// holding the last component and the component itself.
+func splitPath(p string) (int64, string, error) {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return currentDir, p, nil
+	}
+	d, err := bb.ResolveFrom(currentDir, p[:i+1])
+	if err != nil {
+		return 0, "", err
+	}
+	if !d.IsDir() {
+		return 0, "", fmt.Errorf("%s is not a directory", p[:i])
+	}
+	return d.Id, p[i+1:], nil
+}
+
+// Looks up an entry in the directory listing by its name or hex ID.
+func findEntry(de []*client.RemoteFile, n string) *client.RemoteFile {
+	id := getHexId(n)
+	for _, e := range de {
+		if (id != 0 && e.Id == id) || (id == 0 && e.Name() == n) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Finds a file by path, returning it with its directory. See findVersion.
+func findFile(p string) (int64, *client.RemoteFile, error) {
+	d, n, err := splitPath(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	e, err := findVersion(d, n)
+	return d, e, err
+}
+
+// Finds a file in directory d by hex ID, name, or name with a version
+// selector: name@-N picks the Nth version before the newest one and name@date
+// the newest version modified at or before that date.
+func findVersion(d int64, n string) (*client.RemoteFile, error) {
+	if id := getHexId(n); id != 0 {
+		de, err := listDirectory(d)
+		if err != nil {
+			return nil, err
+		}
+		if e := findEntry(de, n); e != nil && !e.IsDir() {
+			return e, nil
+		}
+		return nil, fmt.Errorf("can not find file %s", n)
+	}
+
+	de, err := viewDirectory(d)
+	if err != nil {
+		return nil, err
+	}
+	if v := client.Versions(de, n); len(v) > 0 {
+		// Prefer the current version over deleted and old ones.
+		for _, e := range v {
+			if e.Flags&(proto.Flags_Deleted|proto.Flags_OldVersion) == 0 {
+				return e, nil
+			}
+		}
+		return v[0], nil
+	}
+
+	i := strings.LastIndex(n, "@")
+	if i < 0 {
+		return nil, fmt.Errorf("can not find file %s", n)
+	}
+	if de, err = listDirectory(d); err != nil {
+		return nil, err
+	}
+	v := client.Versions(de, n[:i])
+	if len(v) == 0 {
+		return nil, fmt.Errorf("can not find file %s", n[:i])
+	}
+
+	sel := n[i+1:]
+	if strings.HasPrefix(sel, "-") || sel == "0" {
+		c, err := strconv.Atoi(sel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", sel)
+		}
+		if -c >= len(v) {
+			return nil, fmt.Errorf("%s has only %v versions", n[:i], len(v))
+		}
+		return v[-c], nil
+	}
+	t, err := parseDate(sel)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range v {
+		if !e.ModificationTime.After(t) {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("no version of %s at %s", n[:i], sel)
+}
+
+// Formats time elapsed since t in days and hours.
+func formatAge(t time.Time) string {
+	d := time.Since(t)
+	if d < 24*time.Hour {
+		return d.Round(time.Minute).String()
+	}
+	return fmt.Sprintf("%vd%vh", int(d.Hours())/24, int(d.Hours())%24)
+}
+
+func printVersions(p string) {
+	d, n, err := splitPath(p)
+	if err != nil {
+		glg.Error(explain(err))
+		return
+	}
+	de, err := listDirectory(d)
+	if err != nil {
+		fmt.Printf("Can not get directory: %s\n", err)
+		return
+	}
+	v := client.Versions(de, n)
+	if len(v) == 0 {
+		fmt.Printf("No versions of %s found\n", n)
+		return
+	}
+
+	table := simpletable.New()
+	table.Header = &simpletable.Header{
+		Cells: []*simpletable.Cell{
+			{Align: simpletable.AlignCenter, Text: "#"},
+			{Align: simpletable.AlignCenter, Text: "ID"},
+			{Align: simpletable.AlignCenter, Text: "Modified"},
+			{Align: simpletable.AlignCenter, Text: "Age"},
+			{Align: simpletable.AlignCenter, Text: "Size"},
+			{Align: simpletable.AlignCenter, Text: "Status"},
+		},
+	}
+	for i, e := range v {
+		var st []string
+		if e.Flags&proto.Flags_OldVersion != 0 {
+			st = append(st, "old")
+		}
+		if e.Flags&proto.Flags_Deleted != 0 {
+			st = append(st, "deleted")
+		}
+		if len(st) == 0 {
+			st = append(st, "current")
+		}
+		r := []*simpletable.Cell{
+			{Align: simpletable.AlignRight, Text: fmt.Sprintf("@%v", -i)},
+			{Align: simpletable.AlignRight, Text: fmt.Sprintf("%x", e.Id)},
+			{Text: e.ModificationTime.String()},
+			{Align: simpletable.AlignRight, Text: formatAge(e.ModificationTime)},
+			{Align: simpletable.AlignRight, Text: fmt.Sprintf("%v", e.Size())},
+			{Text: strings.Join(st, ", ")},
+		}
+		table.Body.Cells = append(table.Body.Cells, r)
+	}
+	table.SetStyle(simpletable.StyleRounded)
+	fmt.Println(table.String())
+}
+
+// Formats a size in bytes with binary units.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	d, e := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		d *= unit
+		e++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(d), "KMGTPE"[e])
+}
+
+// Formats n as a percentage of limit.
+func formatPercent(n, limit int64) string {
+	if limit <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(limit))
+}
+
+func printUsage() {
+	u, err := bb.GetAccountUsage()
+	if err != nil {
+		glg.Error(explain(err))
+		exitStatus = 2
+		return
+	}
+	if u.AccountName != "" {
+		fmt.Printf("Account %s", u.AccountName)
+	} else {
+		fmt.Print("Account")
+	}
+	fmt.Printf(", block size %v", u.BlockSize)
+	if !u.Enabled {
+		fmt.Print(", disabled")
+	}
+	fmt.Println()
+
+	// Older servers do not count entries, while there is always a root
+	// directory.
+	counted := u.NumDirectories > 0
+
+	table := simpletable.New()
+	table.Header = &simpletable.Header{
+		Cells: []*simpletable.Cell{
+			{Align: simpletable.AlignCenter, Text: "Usage"},
+			{Align: simpletable.AlignCenter, Text: "Size"},
+			{Align: simpletable.AlignCenter, Text: "Entries"},
+			{Align: simpletable.AlignCenter, Text: "Soft limit"},
+			{Align: simpletable.AlignCenter, Text: "Hard limit"},
+		},
+	}
+	for _, r := range []struct {
+		name    string
+		size, n int64
+	}{
+		{"Current files", u.CurrentFiles, u.NumCurrentFiles},
+		{"Old files", u.OldFiles, u.NumOldFiles},
+		{"Deleted files", u.DeletedFiles, u.NumDeletedFiles},
+		{"Directories", u.Directories, u.NumDirectories},
+	} {
+		n := "-"
+		if counted {
+			n = fmt.Sprintf("%v", r.n)
+		}
+		table.Body.Cells = append(table.Body.Cells, []*simpletable.Cell{
+			{Text: r.name},
+			{Align: simpletable.AlignRight, Text: formatSize(r.size)},
+			{Align: simpletable.AlignRight, Text: n},
+			{Align: simpletable.AlignRight, Text: formatPercent(r.size, u.SoftLimit)},
+			{Align: simpletable.AlignRight, Text: formatPercent(r.size, u.HardLimit)},
+		})
+	}
+	table.Footer = &simpletable.Footer{
+		Cells: []*simpletable.Cell{
+			{Text: "Total"},
+			{Align: simpletable.AlignRight, Text: formatSize(u.Used)},
+			{Text: ""},
+			{Align: simpletable.AlignRight, Text: fmt.Sprintf("%s of %s",
+				formatPercent(u.Used, u.SoftLimit), formatSize(u.SoftLimit))},
+			{Align: simpletable.AlignRight, Text: fmt.Sprintf("%s of %s",
+				formatPercent(u.Used, u.HardLimit), formatSize(u.HardLimit))},
+		},
+	}
+	table.SetStyle(simpletable.StyleRounded)
+	fmt.Println(table.String())
+}
+
+// Returns the ID of a directory given by hex ID or path relative to the
+// current one, or 0 if it is not a directory. The last component is looked up
+// at the browsed point in time.
+func findDirectory(p string) int64 {
+	if id := getHexId(p); id != 0 {
+		e, err := bb.ResolveFrom(id, ".")
+		if err != nil {
+			glg.Debugf("Can not resolve %s: %s", p, explain(err))
+			return 0
+		}
+		if !e.IsDir() {
+			return 0
+		}
+		return id
+	}
+	d, n, err := splitPath(p)
+	if err != nil {
+		glg.Error(explain(err))
+		return 0
+	}
+	if n == "" || n == "." || n == ".." {
+		e, err := bb.ResolveFrom(d, n)
+		if err != nil {
+			glg.Error(explain(err))
+			return 0
+		}
+		return e.Id
+	}
+	de, err := viewDirectory(d)
+	if err != nil {
+		glg.Error(explain(err))
+		return 0
+	}
+	var r *client.RemoteFile
+	for _, e := range de {
+		// Prefer the current directory over deleted ones.
+		if e.IsDir() && e.Name() == n && (r == nil || e.Flags&proto.Flags_Deleted == 0) {
+			r = e
+		}
+	}
+	if r == nil {
+		return 0
+	}
+	return r.Id
+}
+
+// Creates a directory path, relative to the current directory unless it starts
+// with a slash. With parents set the missing intermediate components are
+// created as well.
+func makeDirectory(path string, parents bool) error {
+	d := currentDir
+	if strings.HasPrefix(path, "/") {
+		d = client.RootDirectory
+	}
+	comp := strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+	for i, n := range comp {
+		de, err := listDirectory(d)
+		if err != nil {
+			return err
+		}
+		var ch int64
+		for _, e := range de {
+			if e.IsDir() && e.Flags&(proto.Flags_Deleted|proto.Flags_OldVersion) == 0 && e.Name() == n {
+				ch = e.Id
+			}
+		}
+		last := i == len(comp)-1
+		if ch > 0 {
+			if last && !parents {
+				return fmt.Errorf("directory %s already exists", n)
+			}
+			d = ch
+			continue
+		}
+		if !last && !parents {
+			return fmt.Errorf("directory %s does not exist", n)
+		}
+		if ch, err = bb.CreateDirectory(d, n, nil); err != nil {
+			return err
+		}
+		d = ch
+	}
+	return nil
+}
+
 var suggestions = []prompt.Suggest{
 	// Command
 	{Text: "exit", Description: "Exit BoxBackup client"},
 	{Text: "dir", Description: "List directories"},
 	{Text: "ls", Description: "List directories"},
-	{Text: "cd", Description: "Change path"},
+	{Text: "cd", Description: "Change path, or point in time with @date"},
 	{Text: "get", Description: "Get file"},
+	{Text: "mv", Description: "Move or rename file or directory"},
+	{Text: "mkdir", Description: "Create directory"},
+	{Text: "rm", Description: "Delete file"},
+	{Text: "rmdir", Description: "Delete directory"},
+	{Text: "undelete", Description: "Undelete file or directory"},
+	{Text: "restore", Description: "Restore directory tree or file to local disk"},
+	{Text: "versions", Description: "Show versions of a file"},
+	{Text: "verify", Description: "Check that files can be restored, -r recursively"},
+	{Text: "compare", Description: "Compare local directory tree with the store, -d with contents"},
+	{Text: "put", Description: "Upload local file"},
+	{Text: "backup", Description: "Back up local directory tree"},
 }
 
 func livePrefix() (string, bool) {
-	if currentDir == 1 {
-		return ">", true
+	at := ""
+	if !asOf.IsZero() {
+		at = "@" + asOf.Format("2006-01-02 15:04")
 	}
-	n, ok := nameCache[currentDir]
-	if !ok {
-		d, err := bb.GetObjectName(currentDir, 0)
-		if err != nil {
-			glg.Errorf("Unable to lookup %v", currentDir)
-			return ">", false
-		}
-
-		var r []string
-		for _, s := range d {
-			r = append([]string{s}, r...)
-		}
-		nameCache[currentDir] = r
-		n = r
+	if currentDir == client.RootDirectory {
+		return at + ">", true
 	}
-	return strings.Join(n, "/") + ">", true
+	p, err := bb.PathOf(currentDir)
+	if err != nil {
+		glg.Errorf("Unable to lookup %v", currentDir)
+		return ">", false
+	}
+	return strings.TrimPrefix(p, "/") + at + ">", true
 }
 
 func printDirectory(args []string) {
@@ -125,7 +530,7 @@ func printDirectory(args []string) {
 	}
 	var t int64
 
-	de, err := listDirectory(currentDir)
+	de, err := viewDirectory(currentDir)
 	if err != nil {
 		fmt.Printf("Can not get current directory: %s\n", err)
 		return
@@ -160,16 +565,16 @@ func printDirectory(args []string) {
 	fmt.Println(table.String())
 }
 
+// Returns a context canceled by Ctrl-C, so that a transfer can be interrupted
+// without leaving the shell. The returned function has to be called when done.
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
 func executor(in string) {
 	in = strings.TrimSpace(in)
 	blocks := strings.Split(in, " ")
 
-	de, err := listDirectory(currentDir)
-	if err != nil {
-		fmt.Printf("Can not get current directory: %s\n", err)
-		return
-	}
-
 	switch blocks[0] {
 	case "exit", "quit":
 		fmt.Println("Bye!")
@@ -177,34 +582,55 @@ func executor(in string) {
 		os.Exit(0)
 
 	case "refresh":
-		delete(dirCache, currentDir)
+		bb.ClearCache()
+		return
+
+	case "usage", "df":
+		printUsage()
 		return
 
-	case "connect":
+	case "alive", "ping":
+		d, err := bb.Ping()
+		if err != nil {
+			glg.Error(explain(err))
+			return
+		}
+		fmt.Printf("Store is alive, round trip %v\n", d.Round(time.Microsecond))
+		return
+
+	case "reconnect":
+		if err := bb.Reconnect(); err != nil {
+			glg.Errorf("Unable to reconnect: %s", explain(err))
+			return
+		}
+		fmt.Println("Reconnected.")
+		return
 
 	case "get":
-		if len(blocks) > 1 {
-			n := blocks[1]
-			f := getHexId(n)
-			if f == 0 {
-				for _, e := range de {
-					if !e.IsDir() && e.Name() == n {
-						f = e.Id
-					}
-				}
+		// The name may contain spaces, up to a pipe into a command.
+		n := strings.TrimSpace(strings.TrimPrefix(in, blocks[0]))
+		c := []string{"-c", "less"}
+		if i := strings.Index(n, " |"); i >= 0 {
+			c = []string{"-c", strings.TrimSpace(n[i+2:])}
+			n = strings.TrimSpace(n[:i])
+		}
+		if n != "" {
+			var d, f int64
+			if dir, e, err := findFile(n); err != nil {
+				glg.Error(explain(err))
+			} else {
+				d, f = dir, e.Id
 			}
 			if f > 0 {
-				rf, err := bb.OpenFile(currentDir, f)
+				ctx, stop := interruptible()
+				defer stop()
+				rf, err := bb.OpenFileContext(ctx, d, f)
 				if err != nil {
-					glg.Errorf("opening file: %q", err)
+					glg.Errorf("opening file: %q", explain(err))
 					return
 				}
 				defer rf.Close()
 
-				c := []string{"-c", "less"}
-				if len(blocks) > 2 && blocks[2][0] == '|' {
-					c = []string{"-c", strings.Join(blocks[2:], " ")[1:]}
-				}
 				cmd := exec.Command("/bin/sh", c...)
 				cmd.Stdin = rf
 				cmd.Stdout = os.Stdout
@@ -223,56 +649,369 @@ func executor(in string) {
 				return
 			}
 			defer f.Close()
-			rf, err := bb.CreateFile(currentDir, blocks[2])
+			fi, err := f.Stat()
+			if err != nil {
+				glg.Errorf("Unable to stat local file: %s", err)
+				return
+			}
+			d, n, err := splitPath(blocks[2])
+			if err != nil {
+				glg.Error(explain(err))
+				return
+			}
+			rf, err := bb.CreateFile(d, n)
 			if err != nil {
-				glg.Errorf("Unable to open remote file: %s", err)
+				glg.Errorf("Unable to open remote file: %s", explain(err))
 				return
 			}
-			rf.ModificationTime = time.Now()
-			rf.UID = 101
-			rf.GID = 100
+			rf.SetAttributes(fi)
 
 			if _, err := io.Copy(rf, f); err != nil {
-				glg.Errorf("Unable to open remote file: %s", err)
+				glg.Errorf("Unable to open remote file: %s", explain(err))
 				return
 			}
-			if err := rf.Commit(); err != nil {
-				glg.Errorf("Unable to open remote file: %s", err)
+			ctx, stop := interruptible()
+			defer stop()
+			if err := rf.CommitContext(ctx); err != nil {
+				glg.Errorf("Unable to open remote file: %s", explain(err))
 				return
 			}
 		}
 		return
 
-	case "v", "ls", "dir":
-		printDirectory(blocks[1:])
+	case "backup":
+		if len(blocks) != 3 {
+			fmt.Println("Usage: backup <local directory> <remote directory>")
+			return
+		}
+		d := findDirectory(blocks[2])
+		if d == 0 {
+			glg.Errorf("Can not find directory %s", blocks[2])
+			return
+		}
+		err := bb.Backup(blocks[1], d, &client.BackupOptions{
+			Progress: func(p string, action string) {
+				fmt.Printf("%s\t%s\n", action, p)
+			},
+		})
+		if err != nil {
+			glg.Errorf("Backup failed: %s", explain(err))
+		}
 		return
 
-	case "c", "cd":
-		if len(blocks) < 2 || blocks[1] == ".." {
-			if currentDir > 1 {
-				if c, ok := entCache[currentDir]; ok {
-					currentDir = c.ParentId
-				}
+	case "mv":
+		// Moving over a deleted object replaces it, so that needs -f.
+		flags := int32(proto.Flags_MoveAllWithSameName)
+		var a []string
+		for _, f := range blocks[1:] {
+			if f == "-f" {
+				flags |= proto.Flags_AllowMoveOverDeletedObject
+			} else {
+				a = append(a, f)
 			}
+		}
+		if len(a) < 2 {
+			fmt.Println("Usage: mv [-f] <name> <directory> [new name]")
+			fmt.Println("       mv [-f] <name> <new name>")
 			return
 		}
-		if blocks[1] == "/" {
-			currentDir = 1
+		from, n, err := splitPath(a[0])
+		if err != nil {
+			glg.Error(explain(err))
 			return
 		}
+		de, err := listDirectory(from)
+		if err != nil {
+			glg.Error(explain(err))
+			return
+		}
+		e := findEntry(de, n)
+		if e == nil {
+			glg.Errorf("Can not find %s", a[0])
+			return
+		}
+		n = e.Name()
+		to := findDirectory(a[1])
+		switch {
+		case len(a) > 2:
+			if to == 0 {
+				glg.Errorf("Can not find directory %s", a[1])
+				return
+			}
+			n = strings.Join(a[2:], " ")
+		case to == 0:
+			// Not a directory, so the last component is the new name.
+			if to, n, err = splitPath(a[1]); err != nil {
+				glg.Error(explain(err))
+				return
+			}
+		}
+		if err := bb.MoveObject(e.Id, from, to, n, flags); err != nil {
+			glg.Errorf("Unable to move: %s", explain(err))
+		}
+		return
 
+	case "mkdir":
+		p := false
+		var n []string
+		for _, a := range blocks[1:] {
+			if a == "-p" {
+				p = true
+			} else {
+				n = append(n, a)
+			}
+		}
+		if len(n) == 0 {
+			fmt.Println("Usage: mkdir [-p] <path>")
+			return
+		}
+		if err := makeDirectory(strings.Join(n, " "), p); err != nil {
+			glg.Errorf("Unable to create directory: %s", explain(err))
+		}
+		return
+
+	case "rm", "rmdir":
+		if len(blocks) < 2 {
+			fmt.Printf("Usage: %s <name>\n", blocks[0])
+			return
+		}
 		n := strings.Join(blocks[1:], " ")
-		var ch int64
-		if ch = getHexId(n); ch == 0 {
-			for _, e := range de {
-				if (e.Flags&2) != 0 && e.Name() == n {
-					// fmt.Printf("Found dir: %+v\n", e)
-					ch = e.Id
+		d, c, err := splitPath(n)
+		if err != nil {
+			glg.Error(explain(err))
+			return
+		}
+		de, err := listDirectory(d)
+		if err != nil {
+			glg.Error(explain(err))
+			return
+		}
+		var e *client.RemoteFile
+		for _, f := range de {
+			if f.Flags&(proto.Flags_Deleted|proto.Flags_OldVersion) == 0 && (f.Id == getHexId(c) || f.Name() == c) {
+				e = f
+			}
+		}
+		if e == nil {
+			glg.Errorf("Can not find %s", n)
+			return
+		}
+		if e.IsDir() != (blocks[0] == "rmdir") {
+			glg.Errorf("Use rm for files and rmdir for directories")
+			return
+		}
+		if e.IsDir() {
+			err = bb.DeleteDirectory(e.Id)
+		} else {
+			err = bb.DeleteFile(d, e.Name())
+		}
+		if err != nil {
+			glg.Errorf("Unable to delete %s: %s", n, explain(err))
+		}
+		return
+
+	case "undelete":
+		if len(blocks) < 2 {
+			fmt.Println("Usage: undelete <name>")
+			return
+		}
+		n := strings.Join(blocks[1:], " ")
+		d, c, err := splitPath(n)
+		if err != nil {
+			glg.Error(explain(err))
+			return
+		}
+		de, err := listDirectory(d)
+		if err != nil {
+			glg.Error(explain(err))
+			return
+		}
+		var e *client.RemoteFile
+		for _, f := range de {
+			if f.Flags&proto.Flags_Deleted != 0 && (f.Id == getHexId(c) || f.Name() == c) {
+				e = f
+			}
+		}
+		if e == nil {
+			if v, err := findVersion(d, c); err == nil && v.Flags&proto.Flags_Deleted != 0 {
+				e = v
+			}
+		}
+		if e == nil {
+			glg.Errorf("Can not find deleted %s", n)
+			return
+		}
+		if e.IsDir() {
+			err = bb.UndeleteDirectory(e.Id)
+		} else {
+			err = bb.UndeleteFile(d, e.Id)
+		}
+		if err != nil {
+			glg.Errorf("Unable to undelete %s: %s", n, explain(err))
+		}
+		return
+
+	case "restore":
+		ro := &client.RestoreOptions{
+			AsOf: asOf,
+			Progress: func(p string, f *client.RemoteFile) {
+				fmt.Println(p)
+			},
+		}
+		var a []string
+		for _, f := range blocks[1:] {
+			switch f {
+			case "-x":
+				ro.IncludeDeleted = true
+			case "-o":
+				ro.IncludeOld = true
+			case "-c":
+				ro.Resume = true
+			default:
+				a = append(a, f)
+			}
+		}
+		if len(a) != 2 {
+			fmt.Println("Usage: restore [-x] [-o] [-c] <remote directory or file[@version]> <local path>")
+			return
+		}
+		d := findDirectory(a[0])
+		if d == 0 {
+			d, e, err := findFile(a[0])
+			if err != nil {
+				glg.Error(explain(err))
+				return
+			}
+			if err := bb.RestoreFile(d, e, a[1]); err != nil {
+				glg.Errorf("Restore failed: %s", explain(err))
+			}
+			return
+		}
+		if err := bb.Restore(d, a[1], ro); err != nil {
+			glg.Errorf("Restore failed: %s", explain(err))
+		}
+		return
+
+	case "verify":
+		vo := &client.VerifyOptions{
+			Progress: func(p string, f *client.RemoteFile, pr []client.VerifyProblem) {
+				for _, e := range pr {
+					glg.Warnf("%s: %s block %v: %s", p, e.Kind, e.Block, e.Error)
 				}
+			},
+		}
+		var a []string
+		for _, f := range blocks[1:] {
+			switch f {
+			case "-r":
+				vo.Recursive = true
+			case "-o":
+				vo.IncludeOld = true
+			default:
+				a = append(a, f)
 			}
 		}
-		if ch > 0 {
+		n := "."
+		if len(a) > 0 {
+			n = strings.Join(a, " ")
+		}
+		var r *client.VerifyReport
+		if d := findDirectory(n); d != 0 {
+			var err error
+			if r, err = bb.Verify(d, vo); err != nil {
+				glg.Errorf("Verify failed: %s", explain(err))
+				exitStatus = 2
+				return
+			}
+		} else {
+			d, e, err := findFile(n)
+			if err != nil {
+				glg.Error(explain(err))
+				exitStatus = 2
+				return
+			}
+			r = bb.VerifyFile(d, e)
+		}
+		j, _ := json.Marshal(r)
+		fmt.Println(string(j))
+		if !r.OK() {
+			exitStatus = 1
+		}
+		return
+
+	case "compare":
+		co := &client.CompareOptions{
+			Progress: func(d client.CompareDifference) {
+				fmt.Printf("%s\t%s\t%s\t%s\n", d.Kind, d.Path, d.Local, d.Remote)
+			},
+		}
+		var a []string
+		for _, f := range blocks[1:] {
+			if f == "-d" {
+				co.Deep = true
+			} else {
+				a = append(a, f)
+			}
+		}
+		if len(a) != 2 {
+			fmt.Println("Usage: compare [-d] <local directory> <remote directory>")
+			exitStatus = 2
+			return
+		}
+		d := findDirectory(a[1])
+		if d == 0 {
+			glg.Errorf("Can not find directory %s", a[1])
+			exitStatus = 2
+			return
+		}
+		r, err := bb.Compare(a[0], d, co)
+		if err != nil {
+			glg.Errorf("Compare failed: %s", explain(err))
+			exitStatus = 2
+			return
+		}
+		fmt.Printf("Compared %v files in %v directories, %v differences\n",
+			r.Files, r.Directories, len(r.Differences))
+		if !r.OK() {
+			exitStatus = 1
+		}
+		return
+
+	case "versions":
+		if len(blocks) < 2 {
+			fmt.Println("Usage: versions <name>")
+			return
+		}
+		printVersions(strings.Join(blocks[1:], " "))
+		return
+
+	case "v", "ls", "dir":
+		printDirectory(blocks[1:])
+		return
+
+	case "c", "cd":
+		n := ".."
+		if len(blocks) > 1 {
+			n = strings.Join(blocks[1:], " ")
+		}
+		if strings.HasPrefix(n, "@") {
+			if n == "@" || n == "@now" {
+				asOf = time.Time{}
+				return
+			}
+			t, err := parseDate(n[1:])
+			if err != nil {
+				glg.Error(explain(err))
+				return
+			}
+			asOf = t
+			return
+		}
+
+		if ch := findDirectory(n); ch > 0 {
 			currentDir = ch
+		} else {
+			glg.Errorf("Can not find directory %s", n)
 		}
 		return
 	}
@@ -288,10 +1027,20 @@ func completer(in prompt.Document) []prompt.Suggest {
 		return []prompt.Suggest{}
 	}
 
+	// Complete the last component of a path in its directory.
+	d, dp := currentDir, ""
+	if i := strings.LastIndex(w, "/"); i >= 0 && len(blocks) > 1 {
+		var err error
+		if d, _, err = splitPath(w); err != nil {
+			return nil
+		}
+		dp = w[:i+1]
+	}
+
 	var s []prompt.Suggest
-	de, err := listDirectory(currentDir)
+	de, err := viewDirectory(d)
 	if err != nil {
-		glg.Error(err)
+		glg.Error(explain(err))
 		return nil
 	}
 	numeric := false
@@ -315,6 +1064,29 @@ func completer(in prompt.Document) []prompt.Suggest {
 			if !e.IsDir() {
 				continue
 			}
+		case "rm", "rmdir":
+			if e.IsDir() != (blocks[0] == "rmdir") || e.Flags&(proto.Flags_Deleted|proto.Flags_OldVersion) != 0 {
+				continue
+			}
+		case "undelete":
+			if e.Flags&proto.Flags_Deleted == 0 {
+				continue
+			}
+		case "restore", "verify":
+		case "compare":
+			// Local path goes first, remote directory second.
+			if len(blocks) < 3 || !e.IsDir() {
+				continue
+			}
+		case "versions":
+			if e.IsDir() {
+				continue
+			}
+		case "mv":
+			// Source can be anything, destination only a directory.
+			if len(blocks) == 3 && !e.IsDir() {
+				continue
+			}
 		default:
 			if w == "" {
 				return []prompt.Suggest{}
@@ -329,7 +1101,7 @@ func completer(in prompt.Document) []prompt.Suggest {
 			})
 		} else {
 			s = append(s, prompt.Suggest{
-				Text:        e.Name(),
+				Text:        dp + e.Name(),
 				Description: fmt.Sprintf("0x%x", e.Id),
 			})
 		}
@@ -337,15 +1109,53 @@ func completer(in prompt.Document) []prompt.Suggest {
 	return prompt.FilterHasPrefix(s, w, true)
 }
 
+// Connects to the store and logs in. The session reconnects by itself when
+// the connection drops.
+func connect(s *crypto.StoreConnection, host string, cr *crypto.Crypto) (*client.BoxBackup, error) {
+	dial := func() (net.Conn, error) {
+		return s.Connect(host)
+	}
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	b := client.NewBoxBackup(c, cr)
+	b.SetDialer(dial)
+	if err := b.CheckVersion(1); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := b.Login(1, false); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
 func main() {
 	flag.Parse()
+	defer func() {
+		// Runs after closing the session.
+		if exitStatus != 0 {
+			os.Exit(exitStatus)
+		}
+	}()
 
 	cfg, err := client.NewConfig(*flagConfigFile)
 	if err != nil {
-		glg.Error(err)
+		glg.Error(explain(err))
+		exitStatus = 2
 		return
 	}
 
+	if *flagAsOf != "" {
+		if asOf, err = parseDate(*flagAsOf); err != nil {
+			glg.Error(explain(err))
+			exitStatus = 2
+			return
+		}
+	}
+
 	if *flagVerbose {
 		glg.Info("Increased verbosity")
 	} else {
@@ -355,7 +1165,8 @@ func main() {
 
 	cr, err := crypto.NewCrypto(cfg.Strings["KeysFile"])
 	if err != nil {
-		glg.Error(err)
+		glg.Error(explain(err))
+		exitStatus = 2
 		return
 	}
 
@@ -366,32 +1177,25 @@ func main() {
 		cfg.Strings["PrivateKeyFile"],
 	)
 	if err != nil {
-		glg.Error(err)
+		glg.Error(explain(err))
 	}
-	c, err := s.Connect(cfg.Strings["StoreHostname"])
-	if err != nil {
-		glg.Error(err)
-		return
-	}
-	defer c.Close()
-
-	bb = client.NewBoxBackup(c, cr)
-	defer bb.Finish()
-
-	if err := bb.CheckVersion(1); err != nil {
-		glg.Error(err)
+	if bb, err = connect(s, cfg.Strings["StoreHostname"], cr); err != nil {
+		glg.Error(explain(err))
+		exitStatus = 2
 		return
 	}
+	defer func() {
+		bb.Finish()
+		bb.Close()
+	}()
 
-	if err := bb.Login(1, false); err != nil {
-		glg.Error(err)
+	if flag.NArg() > 0 {
+		// Run a single command, for scripts.
+		executor(strings.Join(flag.Args(), " "))
 		return
 	}
 
-	dirCache = make(map[int64][]*client.RemoteFile)
-	entCache = make(map[int64]*client.RemoteFile)
-	nameCache = make(map[int64][]string)
-
+	bb.KeepAlive(*flagKeepAlive)
 	executor("ls")
 	p := prompt.New(
 		executor,
@@ -126,7 +126,7 @@ func main() {
 	r.DumpTrace("login.txt")
 	r.ResetTrace()
 
-	if err := bb.GetAccountUsage(); err != nil {
+	if _, err := bb.GetAccountUsage(); err != nil {
 		glg.Error(err)
 		return
 	}
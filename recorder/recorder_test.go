@@ -129,7 +129,7 @@ func TestGetAccountUsage(t *testing.T) {
 	s.PrintBuffers()
 
 	s.LoadBuffers("getaccountusage.txt")
-	if err := bb.GetAccountUsage(); err != nil {
+	if _, err := bb.GetAccountUsage(); err != nil {
 		t.Errorf("get account usage: %s", err)
 		return
 	}